@@ -1,35 +1,80 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
+	gogit "github.com/go-git/go-git/v5"
+	gogithub "github.com/google/go-github/v61/github"
 	actions "github.com/sethvargo/go-githubactions"
 
 	"gitops-actions/internal/config"
+	"gitops-actions/internal/ghauth"
 	"gitops-actions/internal/git"
+	"gitops-actions/internal/gitea"
 	"gitops-actions/internal/github"
+	"gitops-actions/internal/gitlab"
+	"gitops-actions/internal/provider"
+	"gitops-actions/internal/result"
+	"gitops-actions/internal/tmpl"
 	"gitops-actions/internal/updater"
 	"gitops-actions/internal/version"
 )
 
+// appPermissions are the permissions of the Github App tokens scoped to the config repo.
+// Commit statuses are read along with check runs to evaluate the checks of a PR.
+var appPermissions = map[string]string{
+	"contents":      "write",
+	"pull_requests": "write",
+	"checks":        "read",
+	"statuses":      "read",
+}
+
 func main() {
 	globalConfig := kingpin.Flag("global-config", "Path to the gitops global config file").Envar("GLOBAL_CONFIG").String()
 	appName := kingpin.Flag("app-name", "Name of the app. required if app-config is not provided").Envar("APP_NAME").String()
 	appConfig := kingpin.Flag("app-config", "Path to the gitops app config file. required if app-name is not provided").Envar("APP_CONFIG").String()
-	value := kingpin.Flag("value", "Value to update in the config files").Required().Envar("VALUE").String()
+	value := kingpin.Flag("value", "Value to update in the config files. required by the deploy command").Envar("VALUE").String()
 	ghToken := kingpin.Flag("gh-token", "Github Token for git and Github operations").Envar("GH_TOKEN").String()
-	ghAppKey := kingpin.Flag("gh-app-key", "Github App Key for Github operations").Envar("GH_APP_KEY").String()
+	ghAppKey := kingpin.Flag("gh-app-key", "Github App private key for Github operations, as PEM content, base64-encoded PEM content or a file path").Envar("GH_APP_KEY").String()
 	ghAppId := kingpin.Flag("gh-app-id", "Github App ID for Github operations").Envar("GH_APP_ID").Int64()
-	ghAppInstallationId := kingpin.Flag("gh-app-installation-id", "Github App Installation ID for Github operations").Envar("GH_APP_INSTALLATION_ID").Int64()
+	ghAppInstallationId := kingpin.Flag("gh-app-installation-id", "Github App Installation ID for Github operations. Looked up for the config repo if not provided").Envar("GH_APP_INSTALLATION_ID").Int64()
+	ghAppScopedToken := kingpin.Flag("gh-app-scoped-token", "Restrict the Github App tokens to the config repo and the permissions the action needs").Default("true").Envar("GH_APP_SCOPED_TOKEN").Bool()
 	gitCommitAuthorName := kingpin.Flag("git-commit-author-name", "Author name for git commit").Default("gitops-actions").Envar("GIT_COMMIT_AUTHOR_NAME").String()
 	gitCommitAuthorEmail := kingpin.Flag("git-commit-author-email", "Author email for git commit").Default("gitops-actions@geode.io").Envar("GIT_COMMIT_AUTHOR_EMAIL").String()
-	prTitle := kingpin.Flag("pr-title", "Title for the PR in the config repo").Envar("PR_TITLE").String()
-	prBody := kingpin.Flag("pr-body", "Body for the PR in the config repo").Envar("PR_BODY").String()
+	commitMessage := kingpin.Flag("commit-message", "Template of the commit message in the config repo").Default("automated commit to update tag to {{ .Value }}").Envar("COMMIT_MESSAGE").String()
+	commitTrailers := kingpin.Flag("commit-trailer", "Git trailer template appended to the commit message, as \"Token: value\". Can be repeated").Envar("COMMIT_TRAILERS").Strings()
+	prTitle := kingpin.Flag("pr-title", "Template of the title for the PR in the config repo").Envar("PR_TITLE").String()
+	prBody := kingpin.Flag("pr-body", "Template of the body for the PR in the config repo").Envar("PR_BODY").String()
+	prBodyFile := kingpin.Flag("pr-body-file", "Path to a file with the template of the body for the PR in the config repo").Envar("PR_BODY_FILE").String()
+	cloneDepth := kingpin.Flag("clone-depth", "Number of commits fetched when cloning the config repo. 0 fetches the full history").Default("1").Envar("CLONE_DEPTH").Int()
+	sparseCheckout := kingpin.Flag("sparse-checkout", "Only check out the app directory of the config repo").Envar("SPARSE_CHECKOUT").Bool()
+	diffComment := kingpin.Flag("diff-comment", "Post the diff of the target files as a comment on the PR").Default("true").Envar("DIFF_COMMENT").Bool()
+	cloneFree := kingpin.Flag("clone-free", "Update the config repo through the GitHub API instead of a local clone").Envar("CLONE_FREE").Bool()
+	ghDeployments := kingpin.Flag("gh-deployments", "Record a GitHub deployment to the environment of each auto-deployed stack").Envar("GH_DEPLOYMENTS").Bool()
+	ghDeploymentsRepo := kingpin.Flag("gh-deployments-repo", "Repo of the GitHub deployments and environments, source or config").Default("source").Envar("GH_DEPLOYMENTS_REPO").Enum("source", "config")
+	ghEnvProtection := kingpin.Flag("gh-environment-protection", "Wait for the protection rules of the GitHub environment of each stack before merging").Envar("GH_ENVIRONMENT_PROTECTION").Bool()
+	cleanupAfter := kingpin.Flag("cleanup", "Clean up superseded PRs and stale deployment branches after deploying").Envar("CLEANUP").Bool()
+	branchMaxAge := kingpin.Flag("branch-max-age", "Age after which deployment branches without an open PR are deleted by the cleanup. 0 keeps them").Default("168h").Envar("BRANCH_MAX_AGE").Duration()
+	resultFile := kingpin.Flag("result-file", "Path of the JSON file with the result of the run. Defaults to a file in the runner temp directory").Envar("RESULT_FILE").String()
+	timeout := kingpin.Flag("timeout", "Maximum duration of the run, after which it stops and cleans up. 0 disables it").Envar("TIMEOUT").Duration()
 	ver := kingpin.Flag("version", "Print version").Short('v').Bool()
-	kingpin.Parse()
+	kingpin.Command("deploy", "Update the config repo and deploy the value").Default()
+	cleanupCmd := kingpin.Command("cleanup", "Close superseded PRs and delete stale deployment branches in the config repo")
+	doctorCmd := kingpin.Command("doctor", "Check the access to the config repo and the deployment config without deploying")
+	command := kingpin.Parse()
 
 	if *ver {
 		fmt.Println(version.VersionInfo())
@@ -43,6 +88,16 @@ func main() {
 	actions.Infof(version.BuildContext())
 	actions.EndGroup()
 
+	// The run stops on SIGINT, SIGTERM or the timeout. A second signal terminates it right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
 	actions.Group("✅ Initializing")
 	actions.Debugf("merging configs: global=%s, gitops=%s", *globalConfig, *appConfig)
 	c, err := config.GetConfig(*globalConfig, *appConfig, *appName)
@@ -50,114 +105,691 @@ func main() {
 		actions.Fatalf("error getting config: %s", err.Error())
 	}
 
-	actions.Infof("initializing git client ...")
-	git, err := git.NewClient(&git.ClientOpts{
+	creds := ghauth.Opts{
 		Token:             *ghToken,
 		AppKey:            *ghAppKey,
 		AppId:             *ghAppId,
 		AppInstallationId: *ghAppInstallationId,
-		AuthorName:        *gitCommitAuthorName,
-		AuthorEmail:       *gitCommitAuthorEmail,
+		Owner:             c.Spec.ConfigRepo.Owner,
+		Repo:              c.Spec.ConfigRepo.Repo,
+	}
+	if creds.IsApp() {
+		if *ghAppScopedToken {
+			creds.Permissions = appPermissions
+			err = widenAppScope(&creds, *ghDeployments, *ghEnvProtection, *ghDeploymentsRepo)
+			if err != nil {
+				actions.Fatalf("error scoping github app tokens: %s", err.Error())
+			}
+		}
+		if creds.AppInstallationId == 0 {
+			actions.Infof("looking up the github app installation for %s/%s ...", creds.Owner, creds.Repo)
+			err = creds.ResolveInstallation(ctx)
+			if err != nil {
+				actions.Fatalf("error resolving github app installation: %s", err.Error())
+			}
+			actions.Infof("found github app installation %d", creds.AppInstallationId)
+		}
+	}
+
+	actions.Infof("initializing git client ...")
+	gitClient, err := git.NewClient(ctx, &git.ClientOpts{
+		Opts:        creds,
+		AuthorName:  *gitCommitAuthorName,
+		AuthorEmail: *gitCommitAuthorEmail,
 	})
 	if err != nil {
 		actions.Fatalf("error creating git client: %s", err.Error())
 	}
 
-	actions.Infof("initializing github client ...")
-	gh, err := github.NewClient(&github.ClientOpts{
-		Token:             *ghToken,
-		AppKey:            *ghAppKey,
-		AppId:             *ghAppId,
-		AppInstallationId: *ghAppInstallationId,
-	})
+	var prov provider.Provider
+	var gh *github.Client
+	switch c.GetProvider() {
+	case config.ProviderGitHub:
+		actions.Infof("initializing github client ...")
+		gh, err = github.NewClient(ctx, &creds)
+		prov = gh
+	case config.ProviderGitLab:
+		actions.Infof("initializing gitlab client ...")
+		prov, err = gitlab.NewClient(&gitlab.ClientOpts{
+			Token:   *ghToken,
+			BaseURL: c.BaseUrl(),
+		})
+	case config.ProviderGitea:
+		actions.Infof("initializing gitea client ...")
+		prov, err = gitea.NewClient(&gitea.ClientOpts{
+			Token:   *ghToken,
+			BaseURL: c.BaseUrl(),
+		})
+	}
 	if err != nil {
-		actions.Fatalf("error creating github client: %s", err.Error())
+		actions.Fatalf("error creating %s client: %s", c.GetProvider(), err.Error())
+	}
+	if *cloneFree && gh == nil {
+		actions.Fatalf("clone-free mode is only supported for the github provider")
+	}
+	if (*ghDeployments || *ghEnvProtection) && gh == nil {
+		actions.Fatalf("github deployments and environments are only supported for the github provider")
+	}
+	if command == cleanupCmd.FullCommand() {
+		actions.EndGroup()
+		err = runCleanup(ctx, prov, c, *branchMaxAge)
+		if err != nil {
+			actions.Fatalf("error cleaning up: %s", err.Error())
+		}
+		return
+	}
+	if command == doctorCmd.FullCommand() {
+		actions.EndGroup()
+		err = runPreflight(ctx, prov, c)
+		if err != nil {
+			actions.Fatalf("%s", err.Error())
+		}
+		return
+	}
+	if *value == "" {
+		actions.Fatalf("value is required")
 	}
 	actions.EndGroup()
 
-	for _, d := range c.Spec.Deployments {
-		actions.Group(fmt.Sprintf("🚀 Deployment: %s", d.TargetStack))
-		actions.Infof("Starting the deployment process")
-		defer actions.EndGroup()
-		clonePath, err := os.MkdirTemp("", "gitops-actions-*")
+	var repo *gogit.Repository
+	clonePath := ""
+	cleanup := func() {
+		if clonePath == "" {
+			return
+		}
+		actions.Debugf("cleaning up temp directory ...")
+		err := os.RemoveAll(clonePath)
 		if err != nil {
-			actions.Fatalf("error creating temp directory: %s", err.Error())
+			actions.Warningf("error removing directory: %s", err.Error())
 		}
-		gitOpsRepo := c.RepoUrl()
-		branchName := fmt.Sprintf("%s/%s", c.Spec.ConfigRepo.App, d.TargetStack)
-		appPath := fmt.Sprintf("%s/%s/%s/%s", clonePath, c.Spec.ConfigRepo.AppPathPrefix, c.Spec.ConfigRepo.App, d.TargetStack)
+		clonePath = ""
+	}
+	defer cleanup()
+	// run records the result of each deployment for the following steps of the workflow.
+	run := &result.Run{App: c.Spec.ConfigRepo.App, Value: *value}
+	resultPath := *resultFile
+	if resultPath == "" {
+		dir := os.Getenv("RUNNER_TEMP")
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		resultPath = filepath.Join(dir, "gitops-actions-result.json")
+	}
+	writeResult := func() {
+		err := run.Write(resultPath)
+		if err != nil {
+			actions.Warningf("%s", err)
+		}
+	}
+	// fatalf cleans up the clone and writes the result before exiting, as os.Exit skips deferred calls.
+	fatalf := func(format string, args ...interface{}) {
+		cleanup()
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			actions.Warningf("the run timed out after %s", *timeout)
+		case ctx.Err() != nil:
+			actions.Warningf("the run was cancelled")
+		}
+		if completed := run.Completed(); len(completed) == 0 {
+			actions.Infof("no deployment completed")
+		} else {
+			actions.Infof("completed deployments: %s", strings.Join(completed, ", "))
+		}
+		run.Fail(fmt.Sprintf(format, args...))
+		writeResult()
+		actions.Fatalf(format, args...)
+	}
+
+	err = runPreflight(ctx, prov, c)
+	if err != nil {
+		fatalf("%s, aborting before any change ...", err.Error())
+	}
 
+	cloneOpts := &git.CloneOpts{
+		SourceBranch: c.Spec.Deployments[0].SourceBranch,
+		Depth:        *cloneDepth,
+	}
+	if *sparseCheckout {
+		cloneOpts.SparseDirs = []string{path.Join(c.Spec.ConfigRepo.AppPathPrefix, c.Spec.ConfigRepo.App)}
+	}
+	if !*cloneFree {
+		actions.Group("📥 Cloning")
+		clonePath, err = os.MkdirTemp("", "gitops-actions-*")
+		if err != nil {
+			fatalf("error creating temp directory: %s", err.Error())
+		}
+		gitOpsRepo := c.RepoUrl()
 		actions.Infof("cloning repo: %s", gitOpsRepo)
-		repo, err := git.CloneAndCheckout(gitOpsRepo, clonePath, branchName)
+		repo, err = gitClient.Clone(ctx, gitOpsRepo, clonePath, cloneOpts)
 		if err != nil {
-			actions.Fatalf("error cloning and checking out repo: %s", err.Error())
+			fatalf("error cloning repo: %s", err.Error())
 		}
+		actions.EndGroup()
+	}
 
-		actions.Infof("updating files in %s path", appPath)
-		err = updater.UpdateFiles(c.Spec.TargetFiles, appPath, *value)
+	prBodyTmpl := *prBody
+	if *prBodyFile != "" {
+		if prBodyTmpl != "" {
+			fatalf("only one of --pr-body and --pr-body-file can be set")
+		}
+		b, err := os.ReadFile(*prBodyFile)
 		if err != nil {
-			actions.Fatalf("error updating files: %s", err.Error())
+			fatalf("error reading PR body template: %s", err.Error())
 		}
+		prBodyTmpl = string(b)
+	}
+	if prBodyTmpl == "" {
+		prBodyTmpl = tmpl.DefaultBody
+	}
+
+	// drafts tracks the draft PRs waiting for their checks in the background.
+	var drafts sync.WaitGroup
 
-		actions.Infof("committing and pushing changes ...")
-		hadChanges, err := git.CommitAndPush(repo, fmt.Sprintf("automated commit to update tag to %s", *value))
-		if err != nil && !strings.Contains(err.Error(), "already up-to-date") {
-			hadChanges = false
-			actions.Infof("branch is already up-to-date, skipping ...")
+	tmplData := tmpl.NewData(c.Spec.ConfigRepo.App, *value)
+	for _, d := range c.Spec.Deployments {
+		if ctx.Err() != nil {
+			fatalf("stopping before deployment %s: %s", d.TargetStack, ctx.Err())
 		}
-		if !hadChanges {
-			actions.Infof("no changes to commit, skipping PR creation and deployment ...")
-			err = os.RemoveAll(clonePath)
+		actions.Group(fmt.Sprintf("🚀 Deployment: %s", d.TargetStack))
+		actions.Infof("Starting the deployment process")
+		defer actions.EndGroup()
+		branchName := fmt.Sprintf("%s/%s", c.Spec.ConfigRepo.App, d.TargetStack)
+		res := run.Start(d.TargetStack, branchName)
+		data := tmplData.ForStack(d.TargetStack)
+		commitMessage, err := tmpl.CommitMessage(*commitMessage, *commitTrailers, data)
+		if err != nil {
+			fatalf("error rendering commit message: %s", err.Error())
+		}
+
+		var previous map[string]string
+		var changes []updater.Change
+		var sha string
+		if *cloneFree {
+			appPath := c.AppPath(d.TargetStack)
+			paths := make([]string, len(c.Spec.TargetFiles))
+			targetFiles := make(map[string]config.TargetFile, len(c.Spec.TargetFiles))
+			for i, tf := range c.Spec.TargetFiles {
+				paths[i] = path.Join(appPath, tf.Path)
+				targetFiles[paths[i]] = tf
+			}
+
+			previous = make(map[string]string, len(paths))
+			actions.Infof("updating files in %s path through the GitHub API", appPath)
+			sha, err = gh.CommitFiles(
+				ctx, c.Spec.ConfigRepo.Owner, c.Spec.ConfigRepo.Repo,
+				d.SourceBranch, branchName, commitMessage,
+				&gogithub.CommitAuthor{Name: gitCommitAuthorName, Email: gitCommitAuthorEmail},
+				paths,
+				func(p string, content []byte) ([]byte, error) {
+					tf := targetFiles[p]
+					v, err := updater.CurrentValue(tf, content)
+					if err != nil {
+						actions.Warningf("error reading current value of %s: %s", p, err)
+					}
+					previous[tf.Path] = v
+					updated, err := updater.UpdateContent(tf, content, *value)
+					if err != nil {
+						return nil, err
+					}
+					if !bytes.Equal(content, updated) {
+						changes = append(changes, updater.Change{Path: p, Old: content, New: updated})
+					}
+					return updated, nil
+				},
+			)
+			if errors.Is(err, github.ErrNoChanges) {
+				actions.Infof("no changes to commit, skipping PR creation and deployment ...")
+				res.Skipped = result.SkippedNoChanges
+				res.Completed = true
+				continue
+			}
 			if err != nil {
-				actions.Warningf("error removing directory: %s", err.Error())
+				fatalf("error committing changes: %s", err.Error())
 			}
-			continue
-		}
+		} else {
+			appPath := fmt.Sprintf("%s/%s", clonePath, c.AppPath(d.TargetStack))
 
-		actions.Debugf("cleaning up temp directory ...")
-		err = os.RemoveAll(clonePath)
-		if err != nil {
-			actions.Warningf("error removing directory: %s", err.Error())
+			actions.Infof("checking out branch %s from %s", branchName, d.SourceBranch)
+			err = gitClient.Checkout(ctx, repo, branchName, d.SourceBranch, cloneOpts)
+			if err != nil {
+				fatalf("error checking out branch: %s", err.Error())
+			}
+
+			previous, err = updater.CurrentValues(c.Spec.TargetFiles, appPath)
+			if err != nil {
+				actions.Warningf("error reading current values: %s", err)
+			}
+
+			actions.Infof("updating files in %s path", appPath)
+			changes, err = updater.UpdateFiles(c.Spec.TargetFiles, appPath, *value)
+			if err != nil {
+				fatalf("error updating files: %s", err.Error())
+			}
+			for i := range changes {
+				changes[i].Path = path.Join(c.AppPath(d.TargetStack), changes[i].Path)
+			}
+
+			actions.Infof("committing and pushing changes ...")
+			sha, err = gitClient.CommitAndPush(ctx, repo, branchName, commitMessage)
+			if errors.Is(err, git.ErrNoChanges) {
+				actions.Infof("no changes to commit, skipping PR creation and deployment ...")
+				res.Skipped = result.SkippedNoChanges
+				res.Completed = true
+				continue
+			}
+			if err != nil {
+				fatalf("error committing and pushing changes: %s", err.Error())
+			}
 		}
 
+		res.CommitSha = sha
+
 		prTitle := *prTitle
 		if prTitle == "" {
 			prTitle = fmt.Sprintf("[CI] Automated PR to update %s", branchName)
 		}
-		prBody := *prBody
-		if prBody == "" {
-			prBody = fmt.Sprintf("Automated PR to %s with the new value", branchName)
+		prTitle, err = tmpl.Render("PR title", prTitle, data)
+		if err != nil {
+			fatalf("error rendering PR title: %s", err.Error())
+		}
+		prBody, err := tmpl.Render("PR body", prBodyTmpl, prBodyData(ctx, gh, c.Spec.TargetFiles, branchName, previous, data))
+		if err != nil {
+			fatalf("error rendering PR body: %s", err.Error())
 		}
+		meta, err := prMetadata(d.PullRequest, data)
+		if err != nil {
+			fatalf("error rendering PR metadata: %s", err.Error())
+		}
+		history := provider.HistoryEntry{
+			Value:    *value,
+			PushedAt: time.Now(),
+			Source:   data.RunUrl,
+		}
+
 		actions.Infof("creating PR ...")
-		pr, err := gh.CreatePR(
-			c.Spec.ConfigRepo.Owner, c.Spec.ConfigRepo.Repo,
+		pr, err := prov.CreateChangeRequest(
+			ctx, c.Spec.ConfigRepo.Owner, c.Spec.ConfigRepo.Repo,
 			branchName, d.SourceBranch,
-			prTitle, prBody,
+			prTitle, provider.ComposeBody(prBody, "", history, meta.Labels),
+			d.Draft,
 		)
-		if err != nil && strings.Contains(err.Error(), "pull request already exists") {
-			actions.Infof("PR already exists, skipping ...")
-			if d.AutoDeploy {
-				actions.Infof("Merge and deploy PR ...")
-				pr, err := gh.GetPR(c.Spec.ConfigRepo.Owner, c.Spec.ConfigRepo.Repo, branchName)
-				if err != nil {
-					actions.Fatalf("error getting PR: %s", err.Error())
+		if errors.Is(err, provider.ErrChangeRequestExists) {
+			actions.Infof("PR already exists, updating ...")
+			pr, err = prov.GetChangeRequest(ctx, c.Spec.ConfigRepo.Owner, c.Spec.ConfigRepo.Repo, branchName)
+			if err != nil {
+				fatalf("error getting PR: %s", err.Error())
+			}
+			err = prov.UpdateChangeRequest(ctx, pr, prTitle, provider.ComposeBody(prBody, pr.Body, history, meta.Labels))
+			if err != nil {
+				fatalf("error updating PR: %s", err.Error())
+			}
+			stale := []string{}
+			for _, l := range provider.ManagedLabels(pr.Body) {
+				if !github.Contains(meta.Labels, l) {
+					stale = append(stale, l)
 				}
-				err = gh.Deploy(pr)
+			}
+			if len(stale) > 0 {
+				actions.Infof("removing stale labels %s from PR ...", strings.Join(stale, ", "))
+				err = prov.RemoveLabels(ctx, pr, stale)
 				if err != nil {
-					actions.Fatalf("error deploying: %s. aborting ...", err.Error())
+					fatalf("error removing PR labels: %s", err.Error())
 				}
 			}
+			actions.Infof("PR updated: %s", pr.URL)
 		} else if err != nil {
-			actions.Fatalf("error creating PR: %s", err.Error())
+			fatalf("error creating PR: %s", err.Error())
 		} else {
-			actions.Infof("PR created: %s", pr.GetHTMLURL())
-			if d.AutoDeploy {
-				err = gh.Deploy(pr)
-				if err != nil {
-					actions.Fatalf("error deploying: %s. aborting ...", err.Error())
+			actions.Infof("PR created: %s", pr.URL)
+		}
+		data.PRNumber = pr.Number
+		res.PRNumber, res.PRUrl = pr.Number, pr.URL
+
+		if *diffComment {
+			diff, err := updater.Diff(changes)
+			if err != nil {
+				actions.Warningf("error computing diff: %s", err)
+			} else if err = prov.UpsertComment(ctx, pr, provider.DiffCommentMarker, provider.DiffComment(d.TargetStack, diff)); err != nil {
+				actions.Warningf("error posting diff comment: %s", err)
+			}
+		}
+
+		if !meta.IsEmpty() {
+			actions.Infof("setting labels, reviewers and assignees on PR ...")
+			err = prov.SetMetadata(ctx, pr, meta)
+			if err != nil {
+				fatalf("error setting PR metadata: %s", err.Error())
+			}
+		}
+		if !d.AutoDeploy {
+			if d.Draft && pr.Draft {
+				actions.Infof("waiting in the background for the checks of draft PR #%d ...", pr.Number)
+				drafts.Add(1)
+				go func(pr *provider.ChangeRequest, d config.Deployment) {
+					defer drafts.Done()
+					markReady(ctx, prov, pr, d)
+				}(pr, d)
+			}
+			res.Skipped = result.SkippedManual
+			res.Completed = true
+			continue
+		}
+
+		// in the auto and queue merge modes the run doesn't see the merge unless it waits for it, so the
+		// deployment is only created once the checks passed, in case the run falls back to merging the PR itself.
+		mergedLater := (d.MergeMode == config.MergeModeAuto || d.MergeMode == config.MergeModeQueue) && !d.WaitForMerged
+		var deployment *github.Deployment
+		if *ghDeployments && !mergedLater {
+			deployment = createDeployment(ctx, gh, *ghDeploymentsRepo, c, pr, data)
+		}
+
+		if *ghEnvProtection {
+			err = waitForEnvironment(ctx, gh, *ghDeploymentsRepo, c, d, pr, data)
+			if err != nil {
+				setDeploymentStatus(ctx, deployment, github.DeploymentFailure, err.Error())
+				fatalf("error waiting for environment %s: %s", d.TargetStack, err.Error())
+			}
+		}
+
+		actions.Infof("Merge and deploy PR ...")
+		mergeOpts := provider.MergeOpts{Method: d.GetMergeMethod()}
+		if d.MergeCommit.Title != "" {
+			mergeOpts.CommitTitle, err = tmpl.Render("merge commit title", d.MergeCommit.Title, data)
+			if err != nil {
+				fatalf("error rendering merge commit: %s", err.Error())
+			}
+		}
+		if d.MergeCommit.Body != "" {
+			mergeOpts.CommitBody, err = tmpl.Render("merge commit body", d.MergeCommit.Body, data)
+			if err != nil {
+				fatalf("error rendering merge commit: %s", err.Error())
+			}
+		}
+		merged := false
+		err = prov.DeployChangeRequest(ctx, pr, &provider.DeployOpts{
+			Checks:        d.Checks,
+			Wait:          d.Wait,
+			MergeMode:     d.MergeMode,
+			WaitForMerged: d.WaitForMerged,
+			Merge:         mergeOpts,
+			OnChecksPassed: func() {
+				if *ghDeployments && deployment == nil && mergedLater {
+					deployment = createDeployment(ctx, gh, *ghDeploymentsRepo, c, pr, data)
 				}
-				actions.Infof("PR deployed: %s\n", pr.GetHTMLURL())
+				setDeploymentStatus(ctx, deployment, github.DeploymentInProgress, "Checks passed, merging the PR")
+			},
+			OnMerged: func() { merged = true },
+		})
+		if err != nil {
+			setDeploymentStatus(ctx, deployment, github.DeploymentFailure, err.Error())
+			var checkErr *provider.CheckStateError
+			if errors.As(err, &checkErr) {
+				switch checkErr.State {
+				case provider.CheckStateFailed:
+					fatalf("checks of PR %s failed: %s. aborting ...", pr.URL, strings.Join(checkErr.Checks, ", "))
+				case provider.CheckStatePending:
+					fatalf("timed out waiting for checks of PR %s: %s. aborting ...", pr.URL, strings.Join(checkErr.Checks, ", "))
+				}
+			}
+			fatalf("error deploying: %s. aborting ...", err.Error())
+		}
+		if !merged {
+			actions.Infof("PR will be merged by GitHub: %s", pr.URL)
+			res.Skipped = result.SkippedAutoMerge
+		} else {
+			setDeploymentStatus(ctx, deployment, github.DeploymentSuccess, "PR merged")
+			actions.Infof("PR deployed: %s\n", pr.URL)
+			res.Merged = true
+		}
+		res.Completed = true
+	}
+
+	if *cleanupAfter {
+		err = runCleanup(ctx, prov, c, *branchMaxAge)
+		if err != nil {
+			actions.Warningf("error cleaning up: %s", err.Error())
+		}
+		if ctx.Err() != nil {
+			fatalf("stopped during the cleanup: %s", ctx.Err())
+		}
+	}
+	drafts.Wait()
+	if ctx.Err() != nil {
+		fatalf("stopped while waiting for the checks of draft PRs: %s", ctx.Err())
+	}
+	writeResult()
+}
+
+// createDeployment records a GitHub deployment of the value to the environment named after the stack.
+// In the source repo the deployed ref is the source commit, in the config repo it is the PR branch.
+// It returns nil if the deployment can't be created.
+func createDeployment(ctx context.Context, gh *github.Client, repo string, c *config.GitOpsConfig, pr *provider.ChangeRequest, data *tmpl.Data) *github.Deployment {
+	owner, name, ref := c.Spec.ConfigRepo.Owner, c.Spec.ConfigRepo.Repo, pr.Head
+	if repo == "source" {
+		var ok bool
+		owner, name, ok = strings.Cut(data.SourceRepo, "/")
+		if !ok || data.SourceSha == "" {
+			actions.Warningf("skipping github deployment, the source repo and commit are unknown")
+			return nil
+		}
+		ref = data.SourceSha
+	}
+
+	actions.Infof("creating github deployment to %s in %s/%s ...", data.Stack, owner, name)
+	deployment, err := gh.CreateDeployment(ctx, owner, name, ref, data.Stack,
+		fmt.Sprintf("Deploy %s %s to %s", data.App, data.Value, data.Stack),
+		map[string]interface{}{
+			"app":   data.App,
+			"value": data.Value,
+			"pr":    pr.URL,
+		},
+	)
+	if err != nil {
+		actions.Warningf("skipping github deployment: %s", err)
+		return nil
+	}
+	deployment.LogUrl = data.RunUrl
+	deployment.EnvironmentUrl = pr.URL
+	setDeploymentStatus(ctx, deployment, github.DeploymentQueued, "PR created, waiting for checks")
+	return deployment
+}
+
+// waitForEnvironment enforces the protection rules of the GitHub environment named after the stack.
+// It fails if the branch policy doesn't allow the deployment, then waits for the approval of a
+// required reviewer on the PR and for the wait timer.
+// The environment and its branch policy are those of the source repo with its workflow ref,
+// or of the config repo with the base branch of the PR.
+func waitForEnvironment(ctx context.Context, gh *github.Client, repo string, c *config.GitOpsConfig, d config.Deployment, pr *provider.ChangeRequest, data *tmpl.Data) error {
+	start := time.Now()
+	owner, name, branch := c.Spec.ConfigRepo.Owner, c.Spec.ConfigRepo.Repo, pr.Base
+	if repo == "source" {
+		var ok bool
+		owner, name, ok = strings.Cut(data.SourceRepo, "/")
+		if !ok {
+			return fmt.Errorf("the source repo is unknown")
+		}
+		branch = data.SourceRef
+	}
+
+	rules, err := gh.GetEnvironmentRules(ctx, owner, name, d.TargetStack)
+	if err != nil {
+		return err
+	}
+	if rules == nil {
+		actions.Infof("no environment %s in %s/%s, skipping protection rules", d.TargetStack, owner, name)
+		return nil
+	}
+	err = gh.CheckBranchPolicy(ctx, rules, branch)
+	if err != nil {
+		return err
+	}
+
+	if rules.HasReviewers() {
+		if owner == pr.Owner {
+			err = gh.SetMetadata(ctx, pr, &provider.Metadata{Reviewers: rules.Reviewers, TeamReviewers: rules.Teams})
+			if err != nil {
+				actions.Warningf("error requesting the reviewers of environment %s: %s", d.TargetStack, err)
 			}
 		}
+		err = provider.PollApproval(ctx, d.Wait, func() error { return gh.EnvironmentApproval(ctx, pr, rules, data.Actor) })
+		if err != nil {
+			return err
+		}
+	}
+
+	if remaining := rules.WaitTimer - time.Since(start); remaining > 0 {
+		actions.Infof("waiting %s for the wait timer of environment %s ...", remaining.Round(time.Second), d.TargetStack)
+		return provider.Sleep(ctx, remaining)
+	}
+	return nil
+}
+
+// setDeploymentStatus posts the state of the deployment, if there is one.
+// The status is posted even once the run is cancelled, so that the failure of the deployment is recorded.
+func setDeploymentStatus(ctx context.Context, deployment *github.Deployment, state, description string) {
+	if deployment == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	err := deployment.SetStatus(ctx, state, description)
+	if err != nil {
+		actions.Warningf("%s", err)
+	}
+}
+
+// runPreflight checks the access to the config repo and the deployment config, and prints the results as a table.
+func runPreflight(ctx context.Context, prov provider.Provider, c *config.GitOpsConfig) error {
+	actions.Group("🩺 Preflight")
+	defer actions.EndGroup()
+	results := provider.Preflight(ctx, prov, c)
+	for _, line := range provider.PreflightTable(results) {
+		actions.Infof("%s", line)
+	}
+	if failed := provider.PreflightFailed(results); failed > 0 {
+		return fmt.Errorf("%d of %d preflight checks failed", failed, len(results))
+	}
+	return nil
+}
+
+// runCleanup closes superseded PRs and deletes stale branches of the deployments of the config.
+func runCleanup(ctx context.Context, prov provider.Provider, c *config.GitOpsConfig, branchMaxAge time.Duration) error {
+	actions.Group("🧹 Cleanup")
+	defer actions.EndGroup()
+	opts := provider.CleanupOpts{BranchMaxAge: branchMaxAge}
+	for _, d := range c.Spec.Deployments {
+		opts.Deployments = append(opts.Deployments, provider.DeploymentBranch{
+			Branch: fmt.Sprintf("%s/%s", c.Spec.ConfigRepo.App, d.TargetStack),
+			Base:   d.SourceBranch,
+		})
+	}
+	return provider.Cleanup(ctx, prov, c.Spec.ConfigRepo.Owner, c.Spec.ConfigRepo.Repo, opts)
+}
+
+// markReady waits for the checks of a draft PR to pass and marks it ready for review.
+// The PR stays a draft if its checks fail or time out.
+func markReady(ctx context.Context, prov provider.Provider, pr *provider.ChangeRequest, d config.Deployment) {
+	err := prov.WaitForChecks(ctx, pr, d.Checks, d.Wait)
+	if err != nil {
+		actions.Warningf("PR %s stays a draft, its checks did not pass: %s", pr.URL, err)
+		return
+	}
+	err = prov.MarkReady(ctx, pr)
+	if err != nil {
+		actions.Warningf("error marking PR %s ready for review: %s", pr.URL, err)
+		return
+	}
+	actions.Infof("PR marked ready for review: %s", pr.URL)
+}
+
+// prMetadata renders the label, reviewer and assignee templates of the PR of a deployment.
+func prMetadata(pr config.PullRequest, data *tmpl.Data) (*provider.Metadata, error) {
+	var err error
+	meta := &provider.Metadata{}
+	if meta.Labels, err = tmpl.RenderAll("label", pr.Labels, data); err != nil {
+		return nil, err
+	}
+	if meta.Reviewers, err = tmpl.RenderAll("reviewer", pr.Reviewers, data); err != nil {
+		return nil, err
+	}
+	if meta.TeamReviewers, err = tmpl.RenderAll("team reviewer", pr.TeamReviewers, data); err != nil {
+		return nil, err
+	}
+	if meta.Assignees, err = tmpl.RenderAll("assignee", pr.Assignees, data); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// prBodyData collects the values for the PR body template: the previous value of each target file
+// and, when the source repo is on GitHub, the changelog between the previous and the new value.
+func prBodyData(ctx context.Context, gh *github.Client, targetFiles []config.TargetFile, branch string, previous map[string]string, data *tmpl.Data) *tmpl.BodyData {
+	bd := &tmpl.BodyData{
+		Data:   data,
+		Branch: branch,
+	}
+	for _, tf := range targetFiles {
+		prev := previous[tf.Path]
+		if bd.PreviousValue == "" {
+			bd.PreviousValue = prev
+		}
+		bd.Files = append(bd.Files, tmpl.FileChange{Path: tf.Path, Previous: prev, Value: data.Value})
+	}
+
+	if gh == nil || data.SourceRepo == "" || bd.PreviousValue == "" || bd.PreviousValue == data.Value {
+		return bd
+	}
+	if !github.IsComparable(bd.PreviousValue) || !github.IsComparable(data.Value) {
+		return bd
+	}
+	owner, repo, ok := strings.Cut(data.SourceRepo, "/")
+	if !ok {
+		return bd
+	}
+	changelog, err := gh.Changelog(ctx, owner, repo, bd.PreviousValue, data.Value)
+	if err != nil {
+		actions.Warningf("skipping changelog: %s", err)
+		return bd
+	}
+	bd.Changelog = changelog
+	return bd
+}
+
+// widenAppScope adds the source repo to the scoped app tokens, for the changelog, and the permissions needed
+// by the GitHub deployments and environment protection. An installation token can't reach a source repo of
+// another owner, which fails the run only when the deployments or environments are in the source repo.
+func widenAppScope(creds *ghauth.Opts, deployments, protection bool, deploymentsRepo string) error {
+	if deployments || protection {
+		perms := maps.Clone(creds.Permissions)
+		if deployments {
+			perms["deployments"] = "write"
+		}
+		if protection {
+			// environments are read with the actions permission, and team reviewers with the members permission.
+			perms["actions"] = "read"
+			perms["members"] = "read"
+		}
+		creds.Permissions = perms
+	}
+	needsSource := (deployments || protection) && deploymentsRepo == "source"
+
+	sourceRepo := ""
+	ghCtx, err := actions.Context()
+	if err == nil {
+		sourceRepo = ghCtx.Repository
+	}
+	owner, repo, ok := strings.Cut(sourceRepo, "/")
+	switch {
+	case !ok && needsSource:
+		return fmt.Errorf("the source repo is unknown, set GH_DEPLOYMENTS_REPO to config or GH_APP_SCOPED_TOKEN to false")
+	case !ok:
+		actions.Warningf("the source repo is unknown, the changelog is skipped")
+	case !strings.EqualFold(owner, creds.Owner) && needsSource:
+		return fmt.Errorf("the source repo %s is not owned by %s, the app tokens of the config repo can't access it, set GH_DEPLOYMENTS_REPO to config", sourceRepo, creds.Owner)
+	case !strings.EqualFold(owner, creds.Owner):
+		actions.Warningf("the source repo %s is not owned by %s, the app tokens of the config repo can't access it and the changelog is skipped", sourceRepo, creds.Owner)
+	case !strings.EqualFold(repo, creds.Repo):
+		creds.Repos = append(creds.Repos, repo)
 	}
+	return nil
 }
@@ -3,6 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
 
@@ -20,6 +23,8 @@ type GitOpsConfig struct {
 }
 
 type ConfigRepo struct {
+	Provider      string `yaml:"provider"`
+	Host          string `yaml:"host"`
 	Owner         string `yaml:"owner"`
 	Repo          string `yaml:"repo"`
 	AppPathPrefix string `yaml:"appPathPrefix"`
@@ -40,13 +45,197 @@ type Deployment struct {
 	SourceBranch string `yaml:"sourceBranch"`
 	TargetStack  string `yaml:"targetStack"`
 	AutoDeploy   bool   `yaml:"autoDeploy"`
+	// Draft opens the PR of a deployment without autoDeploy as a draft, which is marked
+	// ready for review once its checks pass.
+	Draft  bool   `yaml:"draft"`
+	Checks Checks `yaml:"checks"`
+	Wait   Wait   `yaml:"wait"`
+	// MergeMode is how an auto-deploy PR is merged, one of direct (default), auto or queue.
+	MergeMode string `yaml:"mergeMode"`
+	// WaitForMerged blocks until the PR is merged in the auto and queue merge modes.
+	WaitForMerged bool `yaml:"waitForMerged"`
+	// MergeMethod is one of squash (default), merge or rebase.
+	MergeMethod string      `yaml:"mergeMethod"`
+	MergeCommit MergeCommit `yaml:"mergeCommit"`
+	PullRequest PullRequest `yaml:"pullRequest"`
+}
+
+// PullRequest holds the templates of the labels and people set on the PR of a deployment.
+type PullRequest struct {
+	Labels        []string `yaml:"labels"`
+	Reviewers     []string `yaml:"reviewers"`
+	TeamReviewers []string `yaml:"teamReviewers"`
+	Assignees     []string `yaml:"assignees"`
+}
+
+// MergeCommit holds the templates of the commit created when merging a PR.
+// The defaults of the git host are used for empty templates.
+type MergeCommit struct {
+	Title string `yaml:"title"`
+	Body  string `yaml:"body"`
+}
+
+const (
+	MergeMethodSquash = "squash"
+	MergeMethodMerge  = "merge"
+	MergeMethodRebase = "rebase"
+)
+
+// GetMergeMethod returns the merge method of the deployment, squash by default.
+func (d Deployment) GetMergeMethod() string {
+	if d.MergeMethod == "" {
+		return MergeMethodSquash
+	}
+	return d.MergeMethod
+}
+
+const (
+	// MergeModeDirect waits for the checks and merges the PR through the API.
+	MergeModeDirect = "direct"
+	// MergeModeAuto enables the native auto-merge of the git host on the PR.
+	MergeModeAuto = "auto"
+	// MergeModeQueue adds the PR to the merge queue of its base branch.
+	MergeModeQueue = "queue"
+)
+
+// Wait configures how long an auto-deploy waits for checks and retries the merge.
+// Polling backs off exponentially from PollInterval up to MaxPollInterval, with jitter.
+type Wait struct {
+	// InitialDelay is waited before the checks are polled for the first time.
+	InitialDelay time.Duration `yaml:"initialDelay"`
+	// ChecksTimeout is the maximum time to wait for the checks to pass.
+	ChecksTimeout time.Duration `yaml:"checksTimeout"`
+	// MergeTimeout is the maximum time to retry the merge once the checks passed.
+	MergeTimeout time.Duration `yaml:"mergeTimeout"`
+	// MergedTimeout is the maximum time to wait for GitHub to merge the PR with WaitForMerged,
+	// once the checks passed. It includes the CI of a merge queue.
+	MergedTimeout time.Duration `yaml:"mergedTimeout"`
+	// ApprovalTimeout is the maximum time to wait for the approval of a required reviewer
+	// of a protected environment.
+	ApprovalTimeout time.Duration `yaml:"approvalTimeout"`
+	PollInterval    time.Duration `yaml:"pollInterval"`
+	MaxPollInterval time.Duration `yaml:"maxPollInterval"`
+}
+
+// WithDefaults returns a copy of the wait config with the defaults for unset values.
+func (w Wait) WithDefaults() Wait {
+	if w.InitialDelay == 0 {
+		w.InitialDelay = 5 * time.Second
+	}
+	if w.ChecksTimeout == 0 {
+		w.ChecksTimeout = 5 * time.Minute
+	}
+	if w.MergeTimeout == 0 {
+		w.MergeTimeout = 2 * time.Minute
+	}
+	if w.MergedTimeout == 0 {
+		w.MergedTimeout = 30 * time.Minute
+	}
+	if w.ApprovalTimeout == 0 {
+		w.ApprovalTimeout = 30 * time.Minute
+	}
+	if w.PollInterval == 0 {
+		w.PollInterval = 5 * time.Second
+	}
+	if w.MaxPollInterval == 0 {
+		w.MaxPollInterval = time.Minute
+	}
+	if w.MaxPollInterval < w.PollInterval {
+		w.MaxPollInterval = w.PollInterval
+	}
+	return w
+}
+
+// Checks selects the checks which have to pass before a PR is auto-deployed.
+// A check is selected if it matches any of Names, Apps, Contexts or the required checks, and is not ignored.
+type Checks struct {
+	// Names of the check runs or commit status contexts which have to pass.
+	Names []string `yaml:"names"`
+	// Contexts are glob patterns of commit status contexts which have to pass, e.g. ci/jenkins/*.
+	Contexts []string `yaml:"contexts"`
+	// Apps are the slugs of the apps whose check runs have to pass, e.g. github-actions.
+	Apps []string `yaml:"apps"`
+	// Required selects all required checks from the branch protection of the source branch.
+	Required bool `yaml:"required"`
+	// Ignore lists names of optional checks which are never waited for.
+	Ignore []string `yaml:"ignore"`
+}
+
+// IsEmpty returns true if no checks are selected explicitly.
+func (c Checks) IsEmpty() bool {
+	return len(c.Names) == 0 && len(c.Apps) == 0 && len(c.Contexts) == 0 && !c.Required
+}
+
+// MatchesContext returns true if the commit status context is selected by Names or Contexts.
+func (c Checks) MatchesContext(context string) bool {
+	for _, n := range c.Names {
+		if n == context {
+			return true
+		}
+	}
+	for _, pattern := range c.Contexts {
+		if ok, _ := path.Match(pattern, context); ok {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+	ProviderGitea  = "gitea"
+)
+
+var defaultHosts = map[string]string{
+	ProviderGitHub: "github.com",
+	ProviderGitLab: "gitlab.com",
+}
+
+// GetProvider returns the git host provider of the config repo, github by default.
+func (g *GitOpsConfig) GetProvider() string {
+	if g.Spec.ConfigRepo.Provider == "" {
+		return ProviderGitHub
+	}
+	return g.Spec.ConfigRepo.Provider
+}
+
+// BaseUrl returns the URL of the git host of the config repo.
+// The host can include a scheme, e.g. http://localhost:3000, otherwise https is used.
+func (g *GitOpsConfig) BaseUrl() string {
+	host := g.Spec.ConfigRepo.Host
+	if host == "" {
+		host = defaultHosts[g.GetProvider()]
+	}
+	if !strings.Contains(host, "://") {
+		host = fmt.Sprintf("https://%s", host)
+	}
+	return strings.TrimSuffix(host, "/")
 }
 
 func (g *GitOpsConfig) RepoUrl() string {
-	return fmt.Sprintf("https://%s/%s/%s", "github.com", g.Spec.ConfigRepo.Owner, g.Spec.ConfigRepo.Repo)
+	return fmt.Sprintf("%s/%s/%s", g.BaseUrl(), g.Spec.ConfigRepo.Owner, g.Spec.ConfigRepo.Repo)
+}
+
+// AppPath returns the path of the given stack of the app relative to the root of the config repo.
+func (g *GitOpsConfig) AppPath(stack string) string {
+	return path.Join(g.Spec.ConfigRepo.AppPathPrefix, g.Spec.ConfigRepo.App, stack)
 }
 
 func (g *GitOpsConfig) Validate() error {
+	switch g.GetProvider() {
+	case ProviderGitHub:
+		if g.Spec.ConfigRepo.Host != "" && g.Spec.ConfigRepo.Host != defaultHosts[ProviderGitHub] {
+			return fmt.Errorf("configRepo.host is not supported for the github provider")
+		}
+	case ProviderGitLab:
+	case ProviderGitea:
+		if g.Spec.ConfigRepo.Host == "" {
+			return fmt.Errorf("configRepo.host is required for the gitea provider")
+		}
+	default:
+		return fmt.Errorf("invalid configRepo.provider: %s", g.Spec.ConfigRepo.Provider)
+	}
 	if g.Spec.ConfigRepo.Owner == "" {
 		return fmt.Errorf("configRepo.owner is required")
 	}
@@ -65,6 +254,25 @@ func (g *GitOpsConfig) Validate() error {
 	if len(g.Spec.Deployments) == 0 {
 		return fmt.Errorf("deployments is required")
 	}
+	for _, d := range g.Spec.Deployments {
+		switch d.MergeMode {
+		case "", MergeModeDirect:
+		case MergeModeAuto, MergeModeQueue:
+			if g.GetProvider() != ProviderGitHub {
+				return fmt.Errorf("deployments.mergeMode %s is only supported for the github provider", d.MergeMode)
+			}
+		default:
+			return fmt.Errorf("invalid deployments.mergeMode: %s", d.MergeMode)
+		}
+		switch d.GetMergeMethod() {
+		case MergeMethodSquash, MergeMethodMerge, MergeMethodRebase:
+		default:
+			return fmt.Errorf("invalid deployments.mergeMethod: %s", d.MergeMethod)
+		}
+		if d.Draft && d.AutoDeploy {
+			return fmt.Errorf("deployments.draft is only supported without autoDeploy")
+		}
+	}
 	return nil
 }
 
@@ -111,6 +319,12 @@ func FinalizeConfig(globalConfig, appConfig *GitOpsConfig, appName string) (*Git
 		finalConf.Spec.ConfigRepo.App = appName
 	}
 	if appConfig != nil {
+		if appConfig.Spec.ConfigRepo.Provider != "" {
+			finalConf.Spec.ConfigRepo.Provider = appConfig.Spec.ConfigRepo.Provider
+		}
+		if appConfig.Spec.ConfigRepo.Host != "" {
+			finalConf.Spec.ConfigRepo.Host = appConfig.Spec.ConfigRepo.Host
+		}
 		if appConfig.Spec.ConfigRepo.Owner != "" {
 			finalConf.Spec.ConfigRepo.Owner = appConfig.Spec.ConfigRepo.Owner
 		}
@@ -0,0 +1,177 @@
+package ghauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	ghinstallationgithub "github.com/google/go-github/v60/github"
+	"github.com/google/go-github/v61/github"
+	actions "github.com/sethvargo/go-githubactions"
+	"golang.org/x/oauth2"
+)
+
+const pemPrefix = "-----BEGIN"
+
+// Opts are the credentials used for GitHub: a token, or a GitHub App installation.
+type Opts struct {
+	Token string
+	// AppKey is the private key of the app, as PEM content, base64-encoded PEM content or a path to a PEM file.
+	AppKey string
+	AppId  int64
+	// AppInstallationId is looked up for the installation on Owner/Repo when it is not set.
+	AppInstallationId int64
+	Owner, Repo       string
+	// Permissions restrict the installation tokens to Repo with the given permissions,
+	// e.g. {"contents": "write"}. Tokens are not restricted when it is empty.
+	Permissions map[string]string
+	// Repos are the other repos of Owner the restricted tokens can access.
+	Repos []string
+}
+
+// IsApp returns true if the credentials are a GitHub App installation.
+func (o *Opts) IsApp() bool {
+	return o.Token == ""
+}
+
+// ReadKey returns the PEM encoded private key of the app key option.
+// The kind of value is detected: PEM content is used as is, an existing file is read,
+// and anything else is decoded from base64.
+func ReadKey(key string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, fmt.Errorf("app key is required when no token is provided")
+	}
+	if strings.HasPrefix(key, pemPrefix) {
+		// secrets pasted on a single line may have escaped newlines.
+		if !strings.Contains(key, "\n") {
+			key = strings.ReplaceAll(key, `\n`, "\n")
+		}
+		return []byte(key), nil
+	}
+	if _, err := os.Stat(key); err == nil {
+		b, err := os.ReadFile(key)
+		if err != nil {
+			return nil, fmt.Errorf("error reading app key file: %s", err)
+		}
+		return b, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(key), ""))
+	if err != nil || !strings.HasPrefix(strings.TrimSpace(string(b)), pemPrefix) {
+		return nil, fmt.Errorf("app key is neither PEM content, base64-encoded PEM content nor an existing file")
+	}
+	return b, nil
+}
+
+// ResolveInstallation looks up the ID of the installation of the app on Owner/Repo with the app JWT,
+// unless it is already set.
+func (o *Opts) ResolveInstallation(ctx context.Context) error {
+	if !o.IsApp() || o.AppInstallationId != 0 {
+		return nil
+	}
+	if o.Owner == "" || o.Repo == "" {
+		return fmt.Errorf("app installation id is required when the repo is unknown")
+	}
+	key, err := ReadKey(o.AppKey)
+	if err != nil {
+		return err
+	}
+	atr, err := ghinstallation.NewAppsTransport(http.DefaultTransport, o.AppId, key)
+	if err != nil {
+		return fmt.Errorf("error creating app transport: %s", err)
+	}
+	inst, _, err := github.NewClient(&http.Client{Transport: atr}).Apps.FindRepositoryInstallation(ctx, o.Owner, o.Repo)
+	if err != nil {
+		return fmt.Errorf("error finding the app installation for %s/%s: %s", o.Owner, o.Repo, err)
+	}
+	o.AppInstallationId = inst.GetID()
+	return nil
+}
+
+// AppTransport returns a transport authenticated as the installation of the app.
+// The installation tokens are restricted to the repos and permissions of the options, if any.
+func AppTransport(ctx context.Context, opts *Opts) (*ghinstallation.Transport, error) {
+	o := *opts
+	err := o.ResolveInstallation(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ReadKey(o.AppKey)
+	if err != nil {
+		return nil, err
+	}
+	itr, err := ghinstallation.New(http.DefaultTransport, o.AppId, o.AppInstallationId, key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating app transport: %s", err)
+	}
+	if len(o.Permissions) > 0 {
+		itr.InstallationTokenOptions, err = tokenOptions(append([]string{o.Repo}, o.Repos...), o.Permissions)
+		if err != nil {
+			return nil, err
+		}
+		// the token request fails as a whole when the installation can't access one of the other repos.
+		if len(o.Repos) > 0 {
+			if _, err = itr.Token(ctx); err != nil {
+				actions.Warningf("the app installation can't create a token for %s, restricting it to %s: %s", strings.Join(o.Repos, ", "), o.Repo, err)
+				itr.InstallationTokenOptions.Repositories = []string{o.Repo}
+			}
+		}
+	}
+	return itr, nil
+}
+
+// tokenOptions restricts installation tokens to the repos with the permissions.
+// The permissions are converted through JSON, as they use the go-github version of ghinstallation.
+func tokenOptions(repos []string, permissions map[string]string) (*ghinstallationgithub.InstallationTokenOptions, error) {
+	b, err := json.Marshal(permissions)
+	if err != nil {
+		return nil, err
+	}
+	perms := &ghinstallationgithub.InstallationPermissions{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(perms)
+	if err != nil {
+		return nil, fmt.Errorf("invalid app token permissions: %s", err)
+	}
+	return &ghinstallationgithub.InstallationTokenOptions{
+		Repositories: repos,
+		Permissions:  perms,
+	}, nil
+}
+
+// TokenPermissions returns the permissions of the installation token of the transport.
+func TokenPermissions(ctx context.Context, itr *ghinstallation.Transport) (map[string]string, error) {
+	_, err := itr.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting installation token: %s", err)
+	}
+	perms, err := itr.Permissions()
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(perms)
+	if err != nil {
+		return nil, err
+	}
+	permissions := map[string]string{}
+	return permissions, json.Unmarshal(b, &permissions)
+}
+
+// HTTPClient returns an http client authenticated with the token, or as the installation of the app.
+func HTTPClient(ctx context.Context, opts *Opts) (*http.Client, error) {
+	if !opts.IsApp() {
+		return oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: opts.Token})), nil
+	}
+	itr, err := AppTransport(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: itr}, nil
+}
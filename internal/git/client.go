@@ -2,16 +2,16 @@ package git
 
 import (
 	"context"
-	net "net/http"
 
 	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+
+	"gitops-actions/internal/ghauth"
 )
 
 type ClientOpts struct {
-	Token, AppKey            string
-	AppId, AppInstallationId int64
-	AuthorName, AuthorEmail  string
+	ghauth.Opts
+	AuthorName, AuthorEmail string
 }
 
 // Client is a wrapper around go-git to simplify git operations.
@@ -21,12 +21,12 @@ type Client struct {
 	authorName  string
 	authorEmail string
 	itr         *ghinstallation.Transport
-	ctx         context.Context
 }
 
-func (c *Client) RefreshToken() error {
+// RefreshToken renews the installation token used for git operations of an app, if it expired.
+func (c *Client) RefreshToken(ctx context.Context) error {
 	if c.authMethod == "app" {
-		token, err := c.itr.Token(c.ctx)
+		token, err := c.itr.Token(ctx)
 		if err != nil {
 			return err
 		}
@@ -36,21 +36,20 @@ func (c *Client) RefreshToken() error {
 }
 
 // NewClient creates a new git client.
-func NewClient(opts *ClientOpts) (*Client, error) {
+func NewClient(ctx context.Context, opts *ClientOpts) (*Client, error) {
 	client := Client{
 		authorName:  opts.AuthorName,
 		authorEmail: opts.AuthorEmail,
 	}
 	token := opts.Token
-	if token == "" {
+	if opts.IsApp() {
 		client.authMethod = "app"
-		client.ctx = context.Background()
-		itr, err := ghinstallation.NewKeyFromFile(net.DefaultTransport, opts.AppId, opts.AppInstallationId, opts.AppKey)
+		itr, err := ghauth.AppTransport(ctx, &opts.Opts)
 		if err != nil {
 			return nil, err
 		}
 		client.itr = itr
-		token, err = itr.Token(client.ctx)
+		token, err = itr.Token(ctx)
 		if err != nil {
 			return nil, err
 		}
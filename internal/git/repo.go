@@ -1,25 +1,92 @@
 package git
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
 	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
 	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
+// ErrNoChanges is returned by CommitAndPush when there is nothing to push.
+var ErrNoChanges = errors.New("no changes to commit")
+
+// CloneOpts limits how much of a repository is fetched and checked out.
+type CloneOpts struct {
+	// SourceBranch is the only branch fetched by Clone. Other source branches are fetched on demand.
+	SourceBranch string
+	// Depth limits the fetched history to the given number of commits. 0 fetches the full history.
+	Depth int
+	// SparseDirs limits the checked out files to the given directories. Empty checks out everything.
+	SparseDirs []string
+}
+
 // Clone plane clones a git repository.
-func (c *Client) Clone(url, path string) (*git.Repository, error) {
-	repo, err := git.PlainClone(path, false, &git.CloneOptions{
-		URL:      url,
-		Auth:     c.auth,
-		Progress: nil,
-	})
+// Only the source branch is fetched and nothing is checked out, branches are checked out by Checkout.
+func (c *Client) Clone(ctx context.Context, url, path string, opts *CloneOpts) (*git.Repository, error) {
+	if err := c.RefreshToken(ctx); err != nil {
+		return nil, err
+	}
+	cloneOpts := &git.CloneOptions{
+		URL:          url,
+		Auth:         c.auth,
+		Progress:     nil,
+		SingleBranch: true,
+		Depth:        opts.Depth,
+		NoCheckout:   true,
+	}
+	if opts.SourceBranch != "" {
+		cloneOpts.ReferenceName = plumbing.NewBranchReferenceName(opts.SourceBranch)
+	}
+	repo, err := git.PlainCloneContext(ctx, path, false, cloneOpts)
 	return repo, err
 }
 
-// Checkout checks out a branch in a git repository.
-// TODO: Add support checkout from a different source branch.
-func (c *Client) Checkout(repo *git.Repository, branch string) error {
-	headRef, err := repo.Head()
+// SourceRef returns the commit at the tip of the given branch of origin.
+// Branches which were not fetched by Clone are fetched with the same depth.
+func (c *Client) SourceRef(ctx context.Context, repo *git.Repository, branch string, opts *CloneOpts) (plumbing.Hash, error) {
+	remoteRefName := plumbing.NewRemoteReferenceName("origin", branch)
+	ref, err := repo.Reference(remoteRefName, true)
+	if err == nil {
+		return ref.Hash(), nil
+	}
+	if err != plumbing.ErrReferenceNotFound {
+		return plumbing.ZeroHash, err
+	}
+
+	if err = c.RefreshToken(ctx); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(branch), remoteRefName))},
+		Auth:       c.auth,
+		Depth:      opts.Depth,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return plumbing.ZeroHash, err
+	}
+	ref, err = repo.Reference(remoteRefName, true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return ref.Hash(), nil
+}
+
+// Checkout checks out a new branch from the tip of the source branch.
+// When sparse directories are set, only the files in those directories are written to the worktree.
+func (c *Client) Checkout(ctx context.Context, repo *git.Repository, branch, sourceBranch string, opts *CloneOpts) error {
+	sourceHash, err := c.SourceRef(ctx, repo, sourceBranch, opts)
 	if err != nil {
 		return err
 	}
@@ -28,7 +95,7 @@ func (c *Client) Checkout(repo *git.Repository, branch string) error {
 		Branch: plumbing.ReferenceName(branchRefName),
 		Force:  true,
 	}
-	ref := plumbing.NewHashReference(branchRefName, headRef.Hash())
+	ref := plumbing.NewHashReference(branchRefName, sourceHash)
 	if err = repo.Storer.SetReference(ref); err != nil {
 		return err
 	}
@@ -36,60 +103,156 @@ func (c *Client) Checkout(repo *git.Repository, branch string) error {
 	if err != nil {
 		return err
 	}
-	return w.Checkout(&branchCoOpts)
+	if len(opts.SparseDirs) == 0 {
+		return w.Checkout(&branchCoOpts)
+	}
+
+	// go-git's SparseCheckoutDirectories doesn't mark entries of an empty index as skipped,
+	// so the index is rebuilt from the source commit and only the sparse directories are written.
+	branchCoOpts.Force = false
+	branchCoOpts.Keep = true
+	if err = w.Checkout(&branchCoOpts); err != nil {
+		return err
+	}
+	if err = repo.Storer.SetIndex(&index.Index{Version: 2}); err != nil {
+		return err
+	}
+	if err = w.Reset(&git.ResetOptions{Commit: sourceHash, Mode: git.MixedReset}); err != nil {
+		return err
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+	idx.Version = 3
+	idx.SkipUnless(opts.SparseDirs)
+	if err = repo.Storer.SetIndex(idx); err != nil {
+		return err
+	}
+
+	for _, dir := range opts.SparseDirs {
+		if err = os.RemoveAll(filepath.Join(w.Filesystem.Root(), dir)); err != nil {
+			return err
+		}
+	}
+	commit, err := repo.CommitObject(sourceHash)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	for _, e := range idx.Entries {
+		if e.SkipWorktree {
+			continue
+		}
+		f, err := tree.File(e.Name)
+		if err != nil {
+			return err
+		}
+		if err = writeFile(w, f); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (c *Client) CloneAndCheckout(url, path, branch string) (*git.Repository, error) {
-	if err := c.RefreshToken(); err != nil {
-		return nil, err
+func writeFile(w *git.Worktree, f *object.File) error {
+	mode, err := f.Mode.ToOSFileMode()
+	if err != nil {
+		return err
+	}
+	if err = w.Filesystem.MkdirAll(path.Dir(f.Name), 0755); err != nil {
+		return err
 	}
-	repo, err := c.Clone(url, path)
+	r, err := f.Reader()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = c.Checkout(repo, branch)
-	return repo, err
+	defer r.Close()
+	out, err := w.Filesystem.OpenFile(f.Name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, r)
+	return err
 }
 
-// CommitAndPush commits and pushes changes to a git repository.
-// It returns a boolean indicating whether there was a change to commit and an error if any.
-func (c *Client) CommitAndPush(repo *git.Repository, commitMessage string) (bool, error) {
-	if err := c.RefreshToken(); err != nil {
-		return false, err
+// CommitAndPush commits changes to the checked out branch and pushes only that branch.
+// Files skipped by a sparse checkout are left untouched.
+// It returns the SHA of the commit, or ErrNoChanges if the worktree has no changes against the source
+// branch. A remote branch already at the commit, as on a rerun, is not an error.
+func (c *Client) CommitAndPush(ctx context.Context, repo *git.Repository, branch, commitMessage string) (string, error) {
+	if err := c.RefreshToken(ctx); err != nil {
+		return "", err
 	}
 	w, err := repo.Worktree()
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
-	err = w.AddWithOptions(&git.AddOptions{All: true})
+	idx, err := repo.Storer.Index()
 	if err != nil {
-		return false, err
+		return "", err
+	}
+	skipped := map[string]bool{}
+	for _, e := range idx.Entries {
+		if e.SkipWorktree {
+			skipped[e.Name] = true
+		}
 	}
 
 	s, err := w.Status()
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	if s.IsClean() {
-		return false, nil
+	hadChanges := false
+	for p, fs := range s {
+		if skipped[p] || strings.HasPrefix(p, ".git/") {
+			continue
+		}
+		switch fs.Worktree {
+		case git.Unmodified:
+			if fs.Staging == git.Unmodified {
+				continue
+			}
+		case git.Deleted:
+			if _, err = w.Remove(p); err != nil {
+				return "", err
+			}
+		default:
+			if _, err = w.Add(p); err != nil {
+				return "", err
+			}
+		}
+		hadChanges = true
+	}
+	if !hadChanges {
+		return "", ErrNoChanges
 	}
 
-	_, err = w.Commit(commitMessage, &git.CommitOptions{
-		All: true,
+	hash, err := w.Commit(commitMessage, &git.CommitOptions{
 		Author: &object.Signature{
 			Name:  c.authorName,
 			Email: c.authorEmail,
+			When:  time.Now(),
 		},
 	})
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
-	err = repo.Push(&git.PushOptions{
+	branchRefName := plumbing.NewBranchReferenceName(branch)
+	err = repo.PushContext(ctx, &git.PushOptions{
 		Auth:       c.auth,
 		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", branchRefName, branchRefName))},
 		Force:      true,
 	})
-	return true, err
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", fmt.Errorf("error pushing branch %s: %w", branch, err)
+	}
+	return hash.String(), nil
 }
@@ -0,0 +1,43 @@
+package gitea
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"gitops-actions/internal/provider"
+	"gitops-actions/internal/restapi"
+)
+
+// GetAccess implements provider.Provider.
+// Users who can push to the repo can also open pull requests from its branches.
+func (c *Client) GetAccess(ctx context.Context, owner, repo string) (*provider.Access, error) {
+	r := &struct {
+		Permissions struct {
+			Pull bool `json:"pull"`
+			Push bool `json:"push"`
+		} `json:"permissions"`
+	}{}
+	err := c.rest.Do(ctx, http.MethodGet, repoPath(owner, repo), nil, r)
+	if err != nil {
+		return nil, err
+	}
+	return &provider.Access{
+		Read:           r.Permissions.Pull,
+		Push:           r.Permissions.Push,
+		ChangeRequests: r.Permissions.Push,
+		Checks:         r.Permissions.Pull,
+	}, nil
+}
+
+// BranchExists implements provider.Provider.
+func (c *Client) BranchExists(ctx context.Context, owner, repo, branch string) (bool, error) {
+	return restapi.Exists(c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/branches/%s", repoPath(owner, repo), branch), nil, nil))
+}
+
+// PathExists implements provider.Provider.
+func (c *Client) PathExists(ctx context.Context, owner, repo, ref, path string) (bool, error) {
+	q := url.Values{"ref": {ref}}
+	return restapi.Exists(c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/contents/%s?%s", repoPath(owner, repo), path, q.Encode()), nil, nil))
+}
@@ -0,0 +1,37 @@
+package gitea
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gitops-actions/internal/restapi"
+)
+
+// Client is a minimal client for the Gitea REST API v1.
+type Client struct {
+	rest *restapi.Client
+}
+
+type ClientOpts struct {
+	Token, BaseURL string
+}
+
+func NewClient(opts *ClientOpts) (*Client, error) {
+	if opts.Token == "" {
+		return nil, fmt.Errorf("a token is required for gitea")
+	}
+	return &Client{rest: &restapi.Client{
+		HTTP:       http.DefaultClient,
+		Name:       "gitea",
+		BaseURL:    fmt.Sprintf("%s/api/v1", strings.TrimSuffix(opts.BaseURL, "/")),
+		AuthHeader: "Authorization",
+		AuthValue:  fmt.Sprintf("token %s", opts.Token),
+	}}, nil
+}
+
+// repoPath returns the path of the repository API endpoint for owner/repo.
+func repoPath(owner, repo string) string {
+	return fmt.Sprintf("/repos/%s/%s", url.PathEscape(owner), url.PathEscape(repo))
+}
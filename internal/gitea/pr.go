@@ -0,0 +1,438 @@
+package gitea
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	actions "github.com/sethvargo/go-githubactions"
+
+	"gitops-actions/internal/config"
+	"gitops-actions/internal/provider"
+	"gitops-actions/internal/restapi"
+)
+
+type PullRequest struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	HTMLURL string `json:"html_url"`
+	State   string `json:"state"`
+	Head    struct {
+		Ref string `json:"ref"`
+		Sha string `json:"sha"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+}
+
+type combinedStatus struct {
+	Statuses []struct {
+		Context string `json:"context"`
+		Status  string `json:"status"`
+	} `json:"statuses"`
+}
+
+var failedStates = []string{"failure", "error"}
+
+// draftPrefixes are the default title prefixes which mark a pull request as work in progress in Gitea.
+var draftPrefixes = []string{"WIP:", "[WIP]"}
+
+func (c *Client) GetPR(ctx context.Context, owner, repo, branch string) (*PullRequest, error) {
+	for page := 1; ; page++ {
+		prs := []*PullRequest{}
+		err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/pulls?state=open&limit=50&page=%d", repoPath(owner, repo), page), nil, &prs)
+		if err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			if pr.Head.Ref == branch {
+				return pr, nil
+			}
+		}
+		if len(prs) == 0 {
+			return nil, fmt.Errorf("no PR found for branch %s", branch)
+		}
+	}
+}
+
+func (c *Client) CreatePR(ctx context.Context, owner, repo, head, base, title, body string, draft bool) (*PullRequest, error) {
+	if draft {
+		title = fmt.Sprintf("%s %s", draftPrefixes[0], title)
+	}
+	pr := &PullRequest{}
+	err := c.rest.Do(ctx, http.MethodPost, fmt.Sprintf("%s/pulls", repoPath(owner, repo)), map[string]string{
+		"head":  head,
+		"base":  base,
+		"title": title,
+		"body":  body,
+	}, pr)
+	if err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// ChecksErr returns an error unless the selected commit statuses of the PR head succeeded.
+// All statuses are selected when no names or contexts are given.
+func (c *Client) ChecksErr(ctx context.Context, owner, repo string, number int, checks config.Checks) error {
+	pr := &PullRequest{}
+	err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/pulls/%d", repoPath(owner, repo), number), nil, pr)
+	if err != nil {
+		return err
+	}
+	status := &combinedStatus{}
+	err = c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/commits/%s/status", repoPath(owner, repo), pr.Head.Sha), nil, status)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	failed := []string{}
+	pending := []string{}
+	for _, s := range status.Statuses {
+		actions.Debugf("Check: %s, status: %s", s.Context, s.Status)
+		selected := (len(checks.Names) == 0 && len(checks.Contexts) == 0) || checks.MatchesContext(s.Context)
+		if slices.Contains(checks.Ignore, s.Context) || !selected {
+			actions.Debugf("Skipping check %s as it is not selected", s.Context)
+			continue
+		}
+		seen[s.Context] = true
+		if slices.Contains(failedStates, s.Status) {
+			failed = append(failed, fmt.Sprintf("%s (%s)", s.Context, s.Status))
+		} else if s.Status != "success" && s.Status != "warning" {
+			pending = append(pending, s.Context)
+		}
+	}
+	for _, name := range checks.Names {
+		if !seen[name] && !slices.Contains(checks.Ignore, name) {
+			pending = append(pending, name)
+		}
+	}
+
+	if len(failed) > 0 {
+		for _, f := range failed {
+			actions.Infof("check failed: %s", f)
+		}
+		return &provider.CheckStateError{State: provider.CheckStateFailed, Checks: failed}
+	}
+	if len(pending) > 0 {
+		actions.Infof("One or more checks have not completed yet: %s. retrying...", strings.Join(pending, ", "))
+		return &provider.CheckStateError{State: provider.CheckStatePending, Checks: pending}
+	}
+	if len(seen) == 0 {
+		actions.Infof("No checks found for PR. This is likely due to a delay in the checks being reported by Gitea. retrying...")
+		return &provider.CheckStateError{State: provider.CheckStateNotFound}
+	}
+	return nil
+}
+
+func (c *Client) MergePR(ctx context.Context, owner, repo string, number int, opts provider.MergeOpts) error {
+	return c.rest.Do(ctx, http.MethodPost, fmt.Sprintf("%s/pulls/%d/merge", repoPath(owner, repo), number), map[string]string{
+		"Do":                opts.Method,
+		"MergeTitleField":   opts.CommitTitle,
+		"MergeMessageField": opts.CommitBody,
+	}, nil)
+}
+
+// UpdateChangeRequest implements provider.Provider.
+// Draft pull requests keep the work in progress prefix of their title.
+func (c *Client) UpdateChangeRequest(ctx context.Context, cr *provider.ChangeRequest, title, body string) error {
+	if cr.Draft {
+		title = fmt.Sprintf("%s %s", draftPrefixes[0], title)
+	}
+	return c.rest.Do(ctx, http.MethodPatch, fmt.Sprintf("%s/pulls/%d", repoPath(cr.Owner, cr.Repo), cr.Number), map[string]string{
+		"title": title,
+		"body":  body,
+	}, nil)
+}
+
+// RemoveLabels implements provider.Provider.
+func (c *Client) RemoveLabels(ctx context.Context, cr *provider.ChangeRequest, labels []string) error {
+	for _, label := range labels {
+		ids, err := c.labelIDs(ctx, cr.Owner, cr.Repo, []string{label})
+		if err != nil {
+			actions.Debugf("skipping removal of label %s: %s", label, err)
+			continue
+		}
+		err = c.rest.Do(ctx, http.MethodDelete, fmt.Sprintf("%s/issues/%d/labels/%d", repoPath(cr.Owner, cr.Repo), cr.Number, ids[0]), nil, nil)
+		if err != nil && !restapi.HasStatus(err, http.StatusNotFound) {
+			return fmt.Errorf("error removing label %s: %s", label, err)
+		}
+	}
+	return nil
+}
+
+// SetMetadata implements provider.Provider.
+func (c *Client) SetMetadata(ctx context.Context, cr *provider.ChangeRequest, meta *provider.Metadata) error {
+	if len(meta.Labels) > 0 {
+		ids, err := c.labelIDs(ctx, cr.Owner, cr.Repo, meta.Labels)
+		if err != nil {
+			return err
+		}
+		err = c.rest.Do(ctx, http.MethodPost, fmt.Sprintf("%s/issues/%d/labels", repoPath(cr.Owner, cr.Repo), cr.Number), map[string][]int64{
+			"labels": ids,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("error adding labels: %s", err)
+		}
+	}
+	if len(meta.Reviewers) > 0 || len(meta.TeamReviewers) > 0 {
+		err := c.rest.Do(ctx, http.MethodPost, fmt.Sprintf("%s/pulls/%d/requested_reviewers", repoPath(cr.Owner, cr.Repo), cr.Number), map[string][]string{
+			"reviewers":      meta.Reviewers,
+			"team_reviewers": meta.TeamReviewers,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("error requesting reviewers: %s", err)
+		}
+	}
+	if len(meta.Assignees) > 0 {
+		err := c.rest.Do(ctx, http.MethodPatch, fmt.Sprintf("%s/issues/%d", repoPath(cr.Owner, cr.Repo), cr.Number), map[string][]string{
+			"assignees": meta.Assignees,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("error adding assignees: %s", err)
+		}
+	}
+	return nil
+}
+
+// labelIDs looks up the IDs of the given labels of the repo.
+func (c *Client) labelIDs(ctx context.Context, owner, repo string, names []string) ([]int64, error) {
+	byName := map[string]int64{}
+	for page := 1; ; page++ {
+		labels := []struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		}{}
+		err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/labels?limit=50&page=%d", repoPath(owner, repo), page), nil, &labels)
+		if err != nil {
+			return nil, err
+		}
+		if len(labels) == 0 {
+			break
+		}
+		for _, l := range labels {
+			byName[l.Name] = l.ID
+		}
+	}
+	ids := []int64{}
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("label %s not found in %s/%s", name, owner, repo)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ValidateMergeMethod implements provider.Provider.
+func (c *Client) ValidateMergeMethod(ctx context.Context, owner, repo, method string) error {
+	r := &struct {
+		AllowMergeCommits bool `json:"allow_merge_commits"`
+		AllowRebase       bool `json:"allow_rebase"`
+		AllowSquashMerge  bool `json:"allow_squash_merge"`
+	}{}
+	err := c.rest.Do(ctx, http.MethodGet, repoPath(owner, repo), nil, r)
+	if err != nil {
+		return err
+	}
+	allowed := map[string]bool{
+		config.MergeMethodMerge:  r.AllowMergeCommits,
+		config.MergeMethodSquash: r.AllowSquashMerge,
+		config.MergeMethodRebase: r.AllowRebase,
+	}
+	if allowed[method] {
+		return nil
+	}
+	methods := []string{}
+	for _, m := range []string{config.MergeMethodMerge, config.MergeMethodSquash, config.MergeMethodRebase} {
+		if allowed[m] {
+			methods = append(methods, m)
+		}
+	}
+	return fmt.Errorf("merge method %s is not allowed in %s/%s, allowed methods: %s", method, owner, repo, strings.Join(methods, ", "))
+}
+
+// CreateChangeRequest implements provider.Provider.
+func (c *Client) CreateChangeRequest(ctx context.Context, owner, repo, head, base, title, body string, draft bool) (*provider.ChangeRequest, error) {
+	pr, err := c.CreatePR(ctx, owner, repo, head, base, title, body, draft)
+	if restapi.HasStatus(err, http.StatusConflict) {
+		return nil, fmt.Errorf("%w: %s", provider.ErrChangeRequestExists, err)
+	} else if err != nil {
+		return nil, err
+	}
+	return changeRequest(owner, repo, pr), nil
+}
+
+// GetChangeRequest implements provider.Provider.
+func (c *Client) GetChangeRequest(ctx context.Context, owner, repo, head string) (*provider.ChangeRequest, error) {
+	pr, err := c.GetPR(ctx, owner, repo, head)
+	if err != nil {
+		return nil, err
+	}
+	return changeRequest(owner, repo, pr), nil
+}
+
+// DeployChangeRequest implements provider.Provider.
+// Checks are selected by commit status context, apps and required checks are not supported.
+func (c *Client) DeployChangeRequest(ctx context.Context, cr *provider.ChangeRequest, opts *provider.DeployOpts) error {
+	warnUnsupportedChecks(opts.Checks)
+	return provider.WaitAndMerge(ctx, opts,
+		func() error { return c.ChecksErr(ctx, cr.Owner, cr.Repo, cr.Number, opts.Checks) },
+		func() error { return c.MergePR(ctx, cr.Owner, cr.Repo, cr.Number, opts.Merge) },
+	)
+}
+
+// WaitForChecks implements provider.Provider.
+func (c *Client) WaitForChecks(ctx context.Context, cr *provider.ChangeRequest, checks config.Checks, wait config.Wait) error {
+	warnUnsupportedChecks(checks)
+	return provider.PollChecks(ctx, wait, func() error { return c.ChecksErr(ctx, cr.Owner, cr.Repo, cr.Number, checks) })
+}
+
+// warnUnsupportedChecks warns about the check selections which gitea ignores.
+func warnUnsupportedChecks(checks config.Checks) {
+	if len(checks.Apps) > 0 || checks.Required {
+		actions.Warningf("check apps and required checks are not supported for gitea, waiting for the selected commit statuses instead")
+	}
+}
+
+// MarkReady implements provider.Provider.
+func (c *Client) MarkReady(ctx context.Context, cr *provider.ChangeRequest) error {
+	pr := &PullRequest{}
+	err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/pulls/%d", repoPath(cr.Owner, cr.Repo), cr.Number), nil, pr)
+	if err != nil {
+		return err
+	}
+	title, draft := trimDraft(pr.Title)
+	if !draft {
+		return nil
+	}
+	return c.rest.Do(ctx, http.MethodPatch, fmt.Sprintf("%s/pulls/%d", repoPath(cr.Owner, cr.Repo), cr.Number), map[string]string{
+		"title": title,
+	}, nil)
+}
+
+// trimDraft removes the work in progress prefix from the title and reports whether it had one.
+func trimDraft(title string) (string, bool) {
+	for _, prefix := range draftPrefixes {
+		if len(title) >= len(prefix) && strings.EqualFold(title[:len(prefix)], prefix) {
+			return strings.TrimSpace(title[len(prefix):]), true
+		}
+	}
+	return title, false
+}
+
+func changeRequest(owner, repo string, pr *PullRequest) *provider.ChangeRequest {
+	title, draft := trimDraft(pr.Title)
+	return &provider.ChangeRequest{
+		Owner:  owner,
+		Repo:   repo,
+		Number: pr.Number,
+		URL:    pr.HTMLURL,
+		Head:   pr.Head.Ref,
+		Base:   pr.Base.Ref,
+		Title:  title,
+		Body:   pr.Body,
+		Draft:  draft,
+	}
+}
+
+// UpsertComment implements provider.Provider.
+// The comments of an issue are not paginated by Gitea.
+func (c *Client) UpsertComment(ctx context.Context, cr *provider.ChangeRequest, marker, body string) error {
+	comments := []struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+	}{}
+	err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/issues/%d/comments", repoPath(cr.Owner, cr.Repo), cr.Number), nil, &comments)
+	if err != nil {
+		return fmt.Errorf("error listing comments: %s", err)
+	}
+	for _, comment := range comments {
+		if !strings.Contains(comment.Body, marker) {
+			continue
+		}
+		err = c.rest.Do(ctx, http.MethodPatch, fmt.Sprintf("%s/issues/comments/%d", repoPath(cr.Owner, cr.Repo), comment.ID), map[string]string{"body": body}, nil)
+		if err != nil {
+			return fmt.Errorf("error updating comment: %s", err)
+		}
+		return nil
+	}
+
+	err = c.rest.Do(ctx, http.MethodPost, fmt.Sprintf("%s/issues/%d/comments", repoPath(cr.Owner, cr.Repo), cr.Number), map[string]string{"body": body}, nil)
+	if err != nil {
+		return fmt.Errorf("error creating comment: %s", err)
+	}
+	return nil
+}
+
+// ListChangeRequests implements provider.Provider.
+func (c *Client) ListChangeRequests(ctx context.Context, owner, repo, prefix string) ([]*provider.ChangeRequest, error) {
+	crs := []*provider.ChangeRequest{}
+	for page := 1; ; page++ {
+		prs := []*PullRequest{}
+		err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/pulls?state=open&limit=50&page=%d", repoPath(owner, repo), page), nil, &prs)
+		if err != nil {
+			return nil, err
+		}
+		if len(prs) == 0 {
+			return crs, nil
+		}
+		for _, pr := range prs {
+			if strings.HasPrefix(pr.Head.Ref, prefix) {
+				crs = append(crs, changeRequest(owner, repo, pr))
+			}
+		}
+	}
+}
+
+// CloseChangeRequest implements provider.Provider.
+func (c *Client) CloseChangeRequest(ctx context.Context, cr *provider.ChangeRequest, comment string) error {
+	err := c.rest.Do(ctx, http.MethodPost, fmt.Sprintf("%s/issues/%d/comments", repoPath(cr.Owner, cr.Repo), cr.Number), map[string]string{"body": comment}, nil)
+	if err != nil {
+		return fmt.Errorf("error commenting: %s", err)
+	}
+	return c.rest.Do(ctx, http.MethodPatch, fmt.Sprintf("%s/pulls/%d", repoPath(cr.Owner, cr.Repo), cr.Number), map[string]string{
+		"state": "closed",
+	}, nil)
+}
+
+// ListBranches implements provider.Provider.
+func (c *Client) ListBranches(ctx context.Context, owner, repo, prefix string) ([]*provider.Branch, error) {
+	branches := []*provider.Branch{}
+	for page := 1; ; page++ {
+		bs := []struct {
+			Name   string `json:"name"`
+			Commit struct {
+				Timestamp time.Time `json:"timestamp"`
+			} `json:"commit"`
+		}{}
+		err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/branches?limit=50&page=%d", repoPath(owner, repo), page), nil, &bs)
+		if err != nil {
+			return nil, err
+		}
+		if len(bs) == 0 {
+			return branches, nil
+		}
+		for _, b := range bs {
+			if strings.HasPrefix(b.Name, prefix) {
+				branches = append(branches, &provider.Branch{Name: b.Name, CommittedAt: b.Commit.Timestamp})
+			}
+		}
+	}
+}
+
+// DeleteBranch implements provider.Provider.
+func (c *Client) DeleteBranch(ctx context.Context, owner, repo, branch string) error {
+	err := c.rest.Do(ctx, http.MethodDelete, fmt.Sprintf("%s/branches/%s", repoPath(owner, repo), branch), nil, nil)
+	if restapi.HasStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
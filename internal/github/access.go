@@ -0,0 +1,64 @@
+package github
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/go-github/v61/github"
+
+	"gitops-actions/internal/ghauth"
+	"gitops-actions/internal/provider"
+)
+
+// GetAccess implements provider.Provider.
+// The push and pull request access of a token is the role of its user in the repo, that of an app is
+// the permissions of its installation token. Reading checks is probed on the default branch.
+func (c *Client) GetAccess(ctx context.Context, owner, repo string) (*provider.Access, error) {
+	r, _, err := c.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	access := &provider.Access{Read: true}
+	if c.installation != nil {
+		perms, err := ghauth.TokenPermissions(ctx, c.installation)
+		if err != nil {
+			return nil, err
+		}
+		access.Push = perms["contents"] == "write"
+		access.ChangeRequests = perms["pull_requests"] == "write"
+	} else {
+		access.Push = r.GetPermissions()["push"]
+		access.ChangeRequests = access.Push
+	}
+
+	ref := r.GetDefaultBranch()
+	_, resp, err := c.Checks.ListCheckRunsForRef(ctx, owner, repo, ref, &github.ListCheckRunsOptions{ListOptions: github.ListOptions{PerPage: 1}})
+	access.Checks = err == nil || notFound(resp)
+	if access.Checks {
+		_, resp, err = c.Repositories.GetCombinedStatus(ctx, owner, repo, ref, &github.ListOptions{PerPage: 1})
+		access.Checks = err == nil || notFound(resp)
+	}
+	return access, nil
+}
+
+// BranchExists implements provider.Provider.
+func (c *Client) BranchExists(ctx context.Context, owner, repo, branch string) (bool, error) {
+	_, resp, err := c.Repositories.GetBranch(ctx, owner, repo, branch, 0)
+	if notFound(resp) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PathExists implements provider.Provider.
+func (c *Client) PathExists(ctx context.Context, owner, repo, ref, path string) (bool, error) {
+	_, _, resp, err := c.Repositories.GetContents(ctx, owner, repo, path, &github.RepositoryContentGetOptions{Ref: ref})
+	if notFound(resp) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func notFound(resp *github.Response) bool {
+	return resp != nil && resp.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,46 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-github/v61/github"
+
+	"gitops-actions/internal/provider"
+)
+
+// ListBranches implements provider.Provider.
+func (c *Client) ListBranches(ctx context.Context, owner, repo, prefix string) ([]*provider.Branch, error) {
+	branches := []*provider.Branch{}
+	opts := &github.ReferenceListOptions{Ref: fmt.Sprintf("heads/%s", prefix), ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		refs, resp, err := c.Git.ListMatchingRefs(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			commit, _, err := c.Git.GetCommit(ctx, owner, repo, ref.GetObject().GetSHA())
+			if err != nil {
+				return nil, fmt.Errorf("error getting commit of %s: %s", ref.GetRef(), err)
+			}
+			branches = append(branches, &provider.Branch{
+				Name:        ref.GetRef()[len("refs/heads/"):],
+				CommittedAt: commit.GetCommitter().GetDate().Time,
+			})
+		}
+		if resp.NextPage == 0 {
+			return branches, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// DeleteBranch implements provider.Provider.
+func (c *Client) DeleteBranch(ctx context.Context, owner, repo, branch string) error {
+	resp, err := c.Git.DeleteRef(ctx, owner, repo, fmt.Sprintf("heads/%s", branch))
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusUnprocessableEntity) {
+		return err
+	}
+	return nil
+}
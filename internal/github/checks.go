@@ -1,73 +1,217 @@
 package github
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
 
 	"github.com/google/go-github/v61/github"
 	actions "github.com/sethvargo/go-githubactions"
+
+	"gitops-actions/internal/config"
+	"gitops-actions/internal/provider"
 )
 
-// TODO: Make this more configurable to allow for different types of checks
-func (c *Client) WaitForPRChecks(pr *github.PullRequest) error {
-	checks, err := c.GetPRChecks(pr)
+// defaultCheckApps are the apps whose checks gate a PR when no checks are configured.
+var defaultCheckApps = []string{"github-actions"}
+
+// ResolveChecks returns the check selection for a PR into base.
+// The required checks from the branch protection and rulesets of base are added to the names
+// when requested, and the github-actions app is selected when nothing is configured, or when only
+// the required checks are and base has none.
+func (c *Client) ResolveChecks(ctx context.Context, owner, repo, base string, checks config.Checks) (config.Checks, error) {
+	if checks.IsEmpty() {
+		checks.Apps = defaultCheckApps
+		return checks, nil
+	}
+	if !checks.Required {
+		return checks, nil
+	}
+	required, err := c.RequiredChecks(ctx, owner, repo, base)
 	if err != nil {
-		checksErr := c.ChecksErr(checks)
-		switch err.Error() {
-		case "CheckNotCompleted":
-			actions.Infof("One or more checks have not completed yet. retrying...")
-			return checksErr
-		case "CheckFailed":
-			actions.Infof("One or more checks failed. retrying...")
-			return checksErr
-		case "NoChecksFound":
-			actions.Infof("No checks found for PR. This is likely due to a delay in the checks being reported by GitHub. retrying...")
-			return checksErr
-		default:
-			return err
+		return checks, err
+	}
+	if len(required) == 0 && len(checks.Names) == 0 && len(checks.Apps) == 0 && len(checks.Contexts) == 0 {
+		actions.Warningf("no required checks for %s, waiting for the checks of %s instead", base, strings.Join(defaultCheckApps, ", "))
+		checks.Apps = defaultCheckApps
+		return checks, nil
+	}
+	actions.Infof("required checks for %s: %s", base, strings.Join(required, ", "))
+	checks.Names = append(append([]string{}, checks.Names...), required...)
+	return checks, nil
+}
+
+// RequiredChecks returns the names of the status checks required by the branch protection
+// and the rulesets of the branch.
+func (c *Client) RequiredChecks(ctx context.Context, owner, repo, branch string) ([]string, error) {
+	names := []string{}
+	b, _, err := c.Repositories.GetBranch(ctx, owner, repo, branch, 1)
+	if err != nil {
+		return nil, fmt.Errorf("error getting branch %s: %s", branch, err)
+	}
+	if rsc := b.GetProtection().GetRequiredStatusChecks(); rsc != nil {
+		if rsc.Checks != nil {
+			for _, check := range *rsc.Checks {
+				names = appendUnique(names, check.Context)
+			}
+		}
+		if rsc.Contexts != nil {
+			for _, ctx := range *rsc.Contexts {
+				names = appendUnique(names, ctx)
+			}
 		}
 	}
-	return nil
+
+	rules, resp, err := c.Repositories.GetRulesForBranch(ctx, owner, repo, branch)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return names, nil
+		}
+		return nil, fmt.Errorf("error getting rules for branch %s: %s", branch, err)
+	}
+	for _, rule := range rules {
+		if rule.Type != "required_status_checks" || rule.Parameters == nil {
+			continue
+		}
+		params := github.RequiredStatusChecksRuleParameters{}
+		if err := json.Unmarshal(*rule.Parameters, &params); err != nil {
+			return nil, fmt.Errorf("error parsing rule parameters: %s", err)
+		}
+		for _, check := range params.RequiredStatusChecks {
+			names = appendUnique(names, check.Context)
+		}
+	}
+	return names, nil
+}
+
+func (c *Client) WaitForPRChecks(ctx context.Context, pr *github.PullRequest, checks config.Checks) error {
+	runs, err := c.GetPRChecks(ctx, pr)
+	if err != nil {
+		return err
+	}
+	statuses, err := c.GetPRStatuses(ctx, pr)
+	if err != nil {
+		return err
+	}
+	return c.ChecksErr(runs, statuses, checks)
 }
 
-func (c *Client) ChecksErr(checks *github.ListCheckSuiteResults) (err error) {
-	success := true
-	if checks == nil || len(checks.CheckSuites) == 0 {
-		return fmt.Errorf("NoChecksFound")
-	}
-	for _, check := range checks.CheckSuites {
-		success = evaluateConclusion(check.GetConclusion())
-		slug := check.GetApp().GetSlug()
-		actions.Debugf("Check: %d, status: %s, conclusion: %s", check.GetID(), check.GetStatus(), check.GetConclusion())
-		if slug != "github-actions" {
-			actions.Debugf("Skipping check from %s as it is not a github action", slug)
+// ChecksErr evaluates the selected check runs and commit statuses.
+// Failed checks are reported by name and take precedence over pending ones.
+func (c *Client) ChecksErr(runs []*github.CheckRun, statuses []*github.RepoStatus, checks config.Checks) error {
+	seen := map[string]bool{}
+	failed := []string{}
+	pending := []string{}
+	for _, run := range runs {
+		name := run.GetName()
+		slug := run.GetApp().GetSlug()
+		actions.Debugf("Check: %s (%s), status: %s, conclusion: %s", name, slug, run.GetStatus(), run.GetConclusion())
+		if Contains(checks.Ignore, name) {
+			actions.Debugf("Skipping check %s as it is ignored", name)
 			continue
 		}
-		if check.GetStatus() != "completed" {
-			return fmt.Errorf("CheckNotCompleted")
+		if !Contains(checks.Names, name) && !Contains(checks.Apps, slug) {
+			actions.Debugf("Skipping check %s from %s as it is not selected", name, slug)
+			continue
+		}
+		seen[name] = true
+		if run.GetStatus() != "completed" {
+			pending = appendUnique(pending, name)
+		} else if !evaluateConclusion(run.GetConclusion()) {
+			failed = appendUnique(failed, fmt.Sprintf("%s (%s)", name, run.GetConclusion()))
+		}
+	}
+	for _, status := range statuses {
+		context := status.GetContext()
+		actions.Debugf("Status: %s, state: %s", context, status.GetState())
+		if Contains(checks.Ignore, context) {
+			actions.Debugf("Skipping status %s as it is ignored", context)
+			continue
+		}
+		if !checks.MatchesContext(context) {
+			actions.Debugf("Skipping status %s as it is not selected", context)
+			continue
 		}
-		if !success {
-			actions.Infof("one or more checks failed.")
-			return fmt.Errorf("CheckFailed")
+		seen[context] = true
+		switch status.GetState() {
+		case "success":
+		case "pending":
+			pending = appendUnique(pending, context)
+		default:
+			failed = appendUnique(failed, fmt.Sprintf("%s (%s)", context, status.GetState()))
 		}
 	}
+	for _, name := range checks.Names {
+		if !seen[name] && !Contains(checks.Ignore, name) {
+			pending = appendUnique(pending, name)
+		}
+	}
+
+	if len(failed) > 0 {
+		for _, f := range failed {
+			actions.Infof("check failed: %s", f)
+		}
+		return &provider.CheckStateError{State: provider.CheckStateFailed, Checks: failed}
+	}
+	if len(pending) > 0 {
+		actions.Infof("One or more checks have not completed yet: %s. retrying...", strings.Join(pending, ", "))
+		return &provider.CheckStateError{State: provider.CheckStatePending, Checks: pending}
+	}
+	if len(seen) == 0 {
+		actions.Infof("No checks found for PR. This is likely due to a delay in the checks being reported by GitHub. retrying...")
+		return &provider.CheckStateError{State: provider.CheckStateNotFound}
+	}
 	return nil
 }
 
-func (c *Client) GetPRChecks(pr *github.PullRequest) (*github.ListCheckSuiteResults, error) {
+func (c *Client) GetPRChecks(ctx context.Context, pr *github.PullRequest) ([]*github.CheckRun, error) {
 	owner, repo := GetOwnerAndRepo(pr)
 	num := pr.GetNumber()
-	checks, _, err := c.Checks.ListCheckSuitesForRef(c.ctx, owner, repo, fmt.Sprintf("refs/pull/%d/head", num), nil)
-	if err != nil {
-		return nil, err
+	opts := &github.ListCheckRunsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	runs := []*github.CheckRun{}
+	for {
+		res, resp, err := c.Checks.ListCheckRunsForRef(conditional(ctx), owner, repo, fmt.Sprintf("refs/pull/%d/head", num), opts)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, res.CheckRuns...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
 	}
-	return checks, nil
+	return runs, nil
 }
 
-func evaluateConclusion(conclusion string) bool {
-	for _, c := range failedConclusions {
-		if c == conclusion {
-			return false
+// GetPRStatuses returns the latest commit status of each context for the head of the PR.
+func (c *Client) GetPRStatuses(ctx context.Context, pr *github.PullRequest) ([]*github.RepoStatus, error) {
+	owner, repo := GetOwnerAndRepo(pr)
+	num := pr.GetNumber()
+	opts := &github.ListOptions{PerPage: 100}
+	statuses := []*github.RepoStatus{}
+	for {
+		combined, resp, err := c.Repositories.GetCombinedStatus(conditional(ctx), owner, repo, fmt.Sprintf("refs/pull/%d/head", num), opts)
+		if err != nil {
+			return nil, err
 		}
+		statuses = append(statuses, combined.Statuses...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return statuses, nil
+}
+
+func evaluateConclusion(conclusion string) bool {
+	return Contains(passedConclusions, conclusion)
+}
+
+func appendUnique(s []string, e string) []string {
+	if Contains(s, e) {
+		return s
 	}
-	return true
+	return append(s, e)
 }
@@ -2,53 +2,40 @@ package github
 
 import (
 	"context"
-	"fmt"
-	"net/http"
 	"time"
 
+	"github.com/bradleyfalzon/ghinstallation/v2"
 	actions "github.com/sethvargo/go-githubactions"
 
-	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v61/github"
-	"golang.org/x/oauth2"
+
+	"gitops-actions/internal/ghauth"
 )
 
 var (
-	failedConclusions = []string{"failure", "cancelled", "timed_out"}
+	// passedConclusions are the conclusions of completed check runs which pass, any other conclusion fails.
+	passedConclusions = []string{"success", "neutral", "skipped"}
 )
 
 type Client struct {
 	*github.Client
-	ctx context.Context
-}
-
-type ClientOpts struct {
-	Token, AppKey            string
-	AppId, AppInstallationId int64
+	// installation is the transport of the app installation, nil for a token.
+	installation *ghinstallation.Transport
 }
 
-func NewClient(opts *ClientOpts) (*Client, error) {
-	var err error
-	ctx := context.Background()
-	client := github.NewClient(nil)
-
-	if opts.Token != "" {
-		client, err = GetGHClient(opts, ctx, "pat")
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		client, err = GetGHClient(opts, ctx, "app")
-		if err != nil {
-			return nil, err
-		}
-	}
-	c := &Client{
-		Client: client,
-		ctx:    ctx,
+// NewClient creates a GitHub client authenticated with the token or as the app installation.
+// The client waits for the rate limits instead of failing, see rateLimitTransport.
+func NewClient(ctx context.Context, opts *ghauth.Opts) (*Client, error) {
+	httpClient, err := ghauth.HTTPClient(ctx, opts)
+	if err != nil {
+		return nil, err
 	}
+	c := &Client{}
+	c.installation, _ = httpClient.Transport.(*ghinstallation.Transport)
+	httpClient.Transport = newRateLimitTransport(httpClient.Transport)
+	c.Client = github.NewClient(httpClient)
 
-	err = c.CheckRateLimit()
+	err = c.CheckRateLimit(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -56,30 +43,8 @@ func NewClient(opts *ClientOpts) (*Client, error) {
 	return c, nil
 }
 
-func GetGHClient(opts *ClientOpts, ctx context.Context, clientType string) (*github.Client, error) {
-	switch clientType {
-	case "pat":
-		ctx := context.Background()
-		ts := oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: opts.Token},
-		)
-		tc := oauth2.NewClient(ctx, ts)
-		client := github.NewClient(tc)
-		return client, nil
-	case "app":
-		itr, err := ghinstallation.NewKeyFromFile(http.DefaultTransport, opts.AppId, opts.AppInstallationId, opts.AppKey)
-		if err != nil {
-			return nil, err
-		}
-		client := github.NewClient(&http.Client{Transport: itr})
-		return client, nil
-
-	}
-	return nil, fmt.Errorf("invalid client type")
-}
-
-func (c *Client) CheckRateLimit() error {
-	limit, resp, err := c.Client.RateLimit.Get(c.ctx)
+func (c *Client) CheckRateLimit(ctx context.Context) error {
+	limit, resp, err := c.Client.RateLimit.Get(ctx)
 	if err != nil {
 		if resp != nil && resp.StatusCode == 404 {
 			return nil
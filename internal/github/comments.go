@@ -0,0 +1,42 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v61/github"
+
+	"gitops-actions/internal/provider"
+)
+
+// UpsertComment implements provider.Provider.
+func (c *Client) UpsertComment(ctx context.Context, cr *provider.ChangeRequest, marker, body string) error {
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		comments, resp, err := c.Issues.ListComments(ctx, cr.Owner, cr.Repo, cr.Number, opts)
+		if err != nil {
+			return fmt.Errorf("error listing comments: %s", err)
+		}
+		for _, comment := range comments {
+			if !strings.Contains(comment.GetBody(), marker) {
+				continue
+			}
+			_, _, err = c.Issues.EditComment(ctx, cr.Owner, cr.Repo, comment.GetID(), &github.IssueComment{Body: &body})
+			if err != nil {
+				return fmt.Errorf("error updating comment: %s", err)
+			}
+			return nil
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	_, _, err := c.Issues.CreateComment(ctx, cr.Owner, cr.Repo, cr.Number, &github.IssueComment{Body: &body})
+	if err != nil {
+		return fmt.Errorf("error creating comment: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/google/go-github/v61/github"
+
+	"gitops-actions/internal/tmpl"
+)
+
+const (
+	// maxChangelogCommits and maxChangelogFiles bound the size of the changelog in the PR body.
+	maxChangelogCommits = 50
+	maxChangelogFiles   = 100
+	// comparePageSize is the number of commits of each page of a comparison.
+	comparePageSize = 100
+)
+
+// refPattern matches values which can be compared, such as commit SHAs and tags.
+var refPattern = regexp.MustCompile(`^[\w][\w.\-/]*$`)
+
+// IsComparable reports whether the value looks like a commit SHA or a tag.
+func IsComparable(value string) bool {
+	return refPattern.MatchString(value)
+}
+
+// Changelog compares the base and head refs of a repository and returns the commits and
+// the changed files between them.
+// The commits of a comparison are paged from the oldest, so the last pages are read for the most recent ones.
+func (c *Client) Changelog(ctx context.Context, owner, repo, base, head string) (*tmpl.Changelog, error) {
+	comp, _, err := c.Repositories.CompareCommits(ctx, owner, repo, base, head, &github.ListOptions{PerPage: comparePageSize})
+	if err != nil {
+		return nil, fmt.Errorf("error comparing %s...%s: %s", base, head, err)
+	}
+	commits := comp.Commits
+	if total := comp.GetTotalCommits(); total > len(comp.Commits) {
+		commits = nil
+		for page := (total + comparePageSize - 1) / comparePageSize; page > 1 && len(commits) < maxChangelogCommits; page-- {
+			p, _, err := c.Repositories.CompareCommits(ctx, owner, repo, base, head, &github.ListOptions{Page: page, PerPage: comparePageSize})
+			if err != nil {
+				return nil, fmt.Errorf("error comparing %s...%s: %s", base, head, err)
+			}
+			commits = append(p.Commits, commits...)
+		}
+		if len(commits) < maxChangelogCommits {
+			commits = append(comp.Commits, commits...)
+		}
+	}
+
+	cl := &tmpl.Changelog{
+		Base:         base,
+		Head:         head,
+		Url:          comp.GetHTMLURL(),
+		TotalCommits: comp.GetTotalCommits(),
+		TotalFiles:   len(comp.Files),
+	}
+	// the most recent commits are listed first.
+	for i := len(commits) - 1; i >= 0 && len(cl.Commits) < maxChangelogCommits; i-- {
+		commit := commits[i]
+		cl.Commits = append(cl.Commits, tmpl.ChangelogCommit{
+			Sha:     commit.GetSHA(),
+			Message: commit.GetCommit().GetMessage(),
+			Author:  commit.GetAuthor().GetLogin(),
+			Url:     commit.GetHTMLURL(),
+		})
+	}
+	for _, f := range comp.Files {
+		if len(cl.Files) >= maxChangelogFiles {
+			break
+		}
+		cl.Files = append(cl.Files, tmpl.ChangedFile{
+			Name:      f.GetFilename(),
+			Status:    f.GetStatus(),
+			Additions: f.GetAdditions(),
+			Deletions: f.GetDeletions(),
+		})
+	}
+	return cl, nil
+}
@@ -0,0 +1,135 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v61/github"
+	actions "github.com/sethvargo/go-githubactions"
+)
+
+// ErrNoChanges is returned by CommitFiles when the files are already up-to-date.
+var ErrNoChanges = errors.New("no changes to commit")
+
+// UpdateFunc returns the new content of the file at path given its current content.
+type UpdateFunc func(path string, content []byte) ([]byte, error)
+
+// CommitFiles updates files in a repository without a local clone.
+// The given paths are read from the tree and blobs of the tip of the base branch, keeping their mode,
+// passed through update and
+// committed on top of it through the Git Data API. The branch ref is created or force-updated
+// to point to the new commit.
+// It returns the SHA of the new commit, or ErrNoChanges if none of the files changed.
+func (c *Client) CommitFiles(ctx context.Context, owner, repo, base, branch, message string, author *github.CommitAuthor, paths []string, update UpdateFunc) (string, error) {
+	baseRef, _, err := c.Git.GetRef(ctx, owner, repo, fmt.Sprintf("heads/%s", base))
+	if err != nil {
+		return "", fmt.Errorf("error getting ref for branch %s: %s", base, err)
+	}
+	parentSha := baseRef.GetObject().GetSHA()
+	parent, _, err := c.Git.GetCommit(ctx, owner, repo, parentSha)
+	if err != nil {
+		return "", fmt.Errorf("error getting commit %s: %s", parentSha, err)
+	}
+
+	trees := map[string]*github.Tree{}
+	entries := []*github.TreeEntry{}
+	for _, path := range paths {
+		entry, err := c.treeEntry(ctx, owner, repo, parent.GetTree().GetSHA(), path, trees)
+		if err != nil {
+			return "", fmt.Errorf("error reading file %s: %s", path, err)
+		}
+		content, _, err := c.Git.GetBlobRaw(ctx, owner, repo, entry.GetSHA())
+		if err != nil {
+			return "", fmt.Errorf("error reading file %s: %s", path, err)
+		}
+		updated, err := update(path, content)
+		if err != nil {
+			return "", err
+		}
+		if bytes.Equal(updated, content) {
+			actions.Debugf("no changes in %s", path)
+			continue
+		}
+		entries = append(entries, &github.TreeEntry{
+			Path:    github.String(path),
+			Mode:    entry.Mode,
+			Type:    github.String("blob"),
+			Content: github.String(string(updated)),
+		})
+	}
+	if len(entries) == 0 {
+		return "", ErrNoChanges
+	}
+
+	tree, _, err := c.Git.CreateTree(ctx, owner, repo, parent.GetTree().GetSHA(), entries)
+	if err != nil {
+		return "", fmt.Errorf("error creating tree: %s", err)
+	}
+	commit := &github.Commit{
+		Message: github.String(message),
+		Tree:    &github.Tree{SHA: tree.SHA},
+		Parents: []*github.Commit{{SHA: github.String(parentSha)}},
+	}
+	if author != nil {
+		author.Date = &github.Timestamp{Time: time.Now()}
+		commit.Author = author
+	}
+	newCommit, _, err := c.Git.CreateCommit(ctx, owner, repo, commit, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating commit: %s", err)
+	}
+
+	ref := &github.Reference{
+		Ref:    github.String(fmt.Sprintf("refs/heads/%s", branch)),
+		Object: &github.GitObject{SHA: newCommit.SHA},
+	}
+	_, resp, err := c.Git.UpdateRef(ctx, owner, repo, ref, true)
+	if err != nil && resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity) {
+		_, _, err = c.Git.CreateRef(ctx, owner, repo, ref)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error updating ref for branch %s: %s", branch, err)
+	}
+	return newCommit.GetSHA(), nil
+}
+
+// treeEntry returns the blob entry of the path in the tree, reading the trees of its directories
+// one level at a time, as recursive trees of large repos are truncated. trees caches the read trees.
+func (c *Client) treeEntry(ctx context.Context, owner, repo, treeSha, path string, trees map[string]*github.Tree) (*github.TreeEntry, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		tree, ok := trees[treeSha]
+		if !ok {
+			var err error
+			tree, _, err = c.Git.GetTree(ctx, owner, repo, treeSha, false)
+			if err != nil {
+				return nil, err
+			}
+			trees[treeSha] = tree
+		}
+		var entry *github.TreeEntry
+		for _, e := range tree.Entries {
+			if e.GetPath() == part {
+				entry = e
+				break
+			}
+		}
+		switch {
+		case entry == nil:
+			return nil, fmt.Errorf("not found")
+		case i == len(parts)-1 && entry.GetType() != "blob":
+			return nil, fmt.Errorf("not a file")
+		case i == len(parts)-1:
+			return entry, nil
+		case entry.GetType() != "tree":
+			return nil, fmt.Errorf("%s is not a directory", part)
+		}
+		treeSha = entry.GetSHA()
+	}
+	return nil, fmt.Errorf("not found")
+}
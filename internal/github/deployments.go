@@ -0,0 +1,69 @@
+package github
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-github/v61/github"
+)
+
+// maxStatusDescription is the maximum length of the description of a deployment status.
+const maxStatusDescription = 140
+
+// Deployment states posted as deployment statuses.
+const (
+	DeploymentQueued     = "queued"
+	DeploymentInProgress = "in_progress"
+	DeploymentSuccess    = "success"
+	DeploymentFailure    = "failure"
+)
+
+// Deployment is a GitHub deployment of a ref to an environment.
+type Deployment struct {
+	c           *Client
+	Owner, Repo string
+	ID          int64
+	// LogUrl and EnvironmentUrl are linked from each status, if set.
+	LogUrl, EnvironmentUrl string
+}
+
+// CreateDeployment records a deployment of ref to the environment.
+// The deployment is only a record: it doesn't merge the default branch into ref
+// and doesn't require any commit status of ref.
+func (c *Client) CreateDeployment(ctx context.Context, owner, repo, ref, environment, description string, payload map[string]interface{}) (*Deployment, error) {
+	d, _, err := c.Repositories.CreateDeployment(ctx, owner, repo, &github.DeploymentRequest{
+		Ref:              &ref,
+		Task:             github.String("deploy"),
+		AutoMerge:        github.Bool(false),
+		RequiredContexts: &[]string{},
+		Payload:          payload,
+		Environment:      &environment,
+		Description:      &description,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating deployment: %s", err)
+	}
+	return &Deployment{c: c, Owner: owner, Repo: repo, ID: d.GetID()}, nil
+}
+
+// SetStatus posts the state of the deployment. Long descriptions are truncated.
+func (d *Deployment) SetStatus(ctx context.Context, state, description string) error {
+	if len(description) > maxStatusDescription {
+		description = description[:maxStatusDescription-3] + "..."
+	}
+	req := &github.DeploymentStatusRequest{
+		State:       &state,
+		Description: &description,
+	}
+	if d.LogUrl != "" {
+		req.LogURL = &d.LogUrl
+	}
+	if d.EnvironmentUrl != "" {
+		req.EnvironmentURL = &d.EnvironmentUrl
+	}
+	_, _, err := d.c.Repositories.CreateDeploymentStatus(ctx, d.Owner, d.Repo, d.ID, req)
+	if err != nil {
+		return fmt.Errorf("error setting deployment status %s: %s", state, err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v61/github"
+	actions "github.com/sethvargo/go-githubactions"
+
+	"gitops-actions/internal/provider"
+)
+
+// EnvironmentRules are the protection rules of a GitHub environment.
+type EnvironmentRules struct {
+	Owner, Repo, Name string
+	// Reviewers and Teams are the logins and team slugs of the required reviewers, one of them has to approve.
+	Reviewers, Teams []string
+	// PreventSelfReview prevents the user who triggered the deployment from approving it.
+	PreventSelfReview bool
+	WaitTimer         time.Duration
+	// ProtectedBranches only allows deployments from protected branches.
+	ProtectedBranches bool
+	// CustomBranchPolicies only allows deployments from branches matching one of BranchPatterns.
+	CustomBranchPolicies bool
+	BranchPatterns       []string
+}
+
+// HasReviewers returns true if the environment requires an approval.
+func (r *EnvironmentRules) HasReviewers() bool {
+	return len(r.Reviewers) > 0 || len(r.Teams) > 0
+}
+
+// GetEnvironmentRules returns the protection rules of the environment, or nil if the repo has no such environment.
+// GitHub also answers 404 for repos the credentials can't see, so the repo is read before trusting a missing environment.
+func (c *Client) GetEnvironmentRules(ctx context.Context, owner, repo, name string) (*EnvironmentRules, error) {
+	env, resp, err := c.Repositories.GetEnvironment(ctx, owner, repo, name)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		if _, _, err := c.Repositories.Get(ctx, owner, repo); err != nil {
+			return nil, fmt.Errorf("error getting environment %s: can't read repo %s/%s: %s", name, owner, repo, err)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting environment %s: %s", name, err)
+	}
+
+	rules := &EnvironmentRules{Owner: owner, Repo: repo, Name: name}
+	for _, rule := range env.ProtectionRules {
+		switch rule.GetType() {
+		case "required_reviewers":
+			rules.PreventSelfReview = rule.GetPreventSelfReview()
+			for _, r := range rule.Reviewers {
+				switch reviewer := r.Reviewer.(type) {
+				case *github.User:
+					rules.Reviewers = append(rules.Reviewers, reviewer.GetLogin())
+				case *github.Team:
+					rules.Teams = append(rules.Teams, reviewer.GetSlug())
+				}
+			}
+		case "wait_timer":
+			rules.WaitTimer = time.Duration(rule.GetWaitTimer()) * time.Minute
+		}
+	}
+
+	policy := env.GetDeploymentBranchPolicy()
+	rules.ProtectedBranches = policy.GetProtectedBranches()
+	rules.CustomBranchPolicies = policy.GetCustomBranchPolicies()
+	if rules.CustomBranchPolicies {
+		policies, _, err := c.Repositories.ListDeploymentBranchPolicies(ctx, owner, repo, name)
+		if err != nil {
+			return nil, fmt.Errorf("error listing branch policies of environment %s: %s", name, err)
+		}
+		for _, p := range policies.BranchPolicies {
+			if p.GetType() == "" || p.GetType() == "branch" {
+				rules.BranchPatterns = append(rules.BranchPatterns, p.GetName())
+			}
+		}
+	}
+	return rules, nil
+}
+
+// CheckBranchPolicy returns an error if the deployment branch policy of the environment doesn't allow deploying branch.
+func (c *Client) CheckBranchPolicy(ctx context.Context, rules *EnvironmentRules, branch string) error {
+	if rules.ProtectedBranches {
+		b, _, err := c.Repositories.GetBranch(ctx, rules.Owner, rules.Repo, branch, 1)
+		if err != nil {
+			return fmt.Errorf("error getting branch %s: %s", branch, err)
+		}
+		if !b.GetProtected() {
+			return fmt.Errorf("environment %s only allows deployments from protected branches, %s is not protected", rules.Name, branch)
+		}
+	}
+	if rules.CustomBranchPolicies {
+		for _, pattern := range rules.BranchPatterns {
+			if ok, _ := path.Match(pattern, branch); ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("environment %s doesn't allow deployments from branch %s, allowed branches: %s", rules.Name, branch, strings.Join(rules.BranchPatterns, ", "))
+	}
+	return nil
+}
+
+// EnvironmentApproval returns an error until the PR is approved by one of the required reviewers of the environment.
+// When self review is prevented, the approval of actor doesn't count.
+func (c *Client) EnvironmentApproval(ctx context.Context, cr *provider.ChangeRequest, rules *EnvironmentRules, actor string) error {
+	latest := map[string]string{}
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		reviews, resp, err := c.PullRequests.ListReviews(conditional(ctx), cr.Owner, cr.Repo, cr.Number, opts)
+		if err != nil {
+			return fmt.Errorf("error listing reviews: %s", err)
+		}
+		for _, r := range reviews {
+			if r.GetState() == "COMMENTED" {
+				continue
+			}
+			latest[r.GetUser().GetLogin()] = r.GetState()
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	for login, state := range latest {
+		if state != "APPROVED" || (rules.PreventSelfReview && strings.EqualFold(login, actor)) {
+			continue
+		}
+		ok, err := c.isEnvironmentReviewer(ctx, rules, login)
+		if err != nil {
+			return err
+		}
+		if ok {
+			actions.Infof("PR #%d approved by %s, a required reviewer of environment %s", cr.Number, login, rules.Name)
+			return nil
+		}
+	}
+	reviewers := append(append([]string{}, rules.Reviewers...), rules.Teams...)
+	return fmt.Errorf("%w: PR #%d needs an approval from one of %s", provider.ErrApprovalRequired, cr.Number, strings.Join(reviewers, ", "))
+}
+
+// isEnvironmentReviewer returns true if the user is a required reviewer of the environment,
+// directly or as an active member of one of its teams.
+func (c *Client) isEnvironmentReviewer(ctx context.Context, rules *EnvironmentRules, login string) (bool, error) {
+	for _, r := range rules.Reviewers {
+		if strings.EqualFold(r, login) {
+			return true, nil
+		}
+	}
+	for _, team := range rules.Teams {
+		m, resp, err := c.Teams.GetTeamMembershipBySlug(ctx, rules.Owner, team, login)
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("error getting membership of %s in team %s: %s", login, team, err)
+		}
+		if m.GetState() == "active" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,49 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// GraphQLError is returned by GraphQL when the response has errors.
+type GraphQLError struct {
+	Messages []string
+}
+
+func (e *GraphQLError) Error() string {
+	return fmt.Sprintf("graphql error: %s", strings.Join(e.Messages, "; "))
+}
+
+type graphqlRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphqlResponse struct {
+	Data   interface{} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// GraphQL runs a query or mutation against the GitHub GraphQL API and decodes its data into out.
+func (c *Client) GraphQL(ctx context.Context, query string, variables map[string]interface{}, out interface{}) error {
+	req, err := c.Client.NewRequest("POST", "graphql", &graphqlRequest{Query: query, Variables: variables})
+	if err != nil {
+		return err
+	}
+	resp := &graphqlResponse{Data: out}
+	_, err = c.Client.Do(ctx, req, resp)
+	if err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		msgs := make([]string, len(resp.Errors))
+		for i, e := range resp.Errors {
+			msgs[i] = e.Message
+		}
+		return &GraphQLError{Messages: msgs}
+	}
+	return nil
+}
@@ -1,16 +1,21 @@
 package github
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"time"
+	"net/http"
+	"strings"
 
-	"github.com/avast/retry-go/v4"
 	"github.com/google/go-github/v61/github"
 	actions "github.com/sethvargo/go-githubactions"
+
+	"gitops-actions/internal/config"
+	"gitops-actions/internal/provider"
 )
 
-func (c *Client) GetPR(owner, repo, branch string) (*github.PullRequest, error) {
-	prs, _, err := c.PullRequests.List(c.ctx, owner, repo, &github.PullRequestListOptions{
+func (c *Client) GetPR(ctx context.Context, owner, repo, branch string) (*github.PullRequest, error) {
+	prs, _, err := c.PullRequests.List(ctx, owner, repo, &github.PullRequestListOptions{
 		Head: fmt.Sprintf("%s:%s", owner, branch),
 	})
 	if err != nil {
@@ -22,25 +27,53 @@ func (c *Client) GetPR(owner, repo, branch string) (*github.PullRequest, error)
 	return prs[0], nil
 }
 
-func (c *Client) CreatePR(owner, repo, head, base, title, body string) (*github.PullRequest, error) {
+// ErrPRExists is returned by CreatePR when a PR is already open for the head branch.
+// It is the provider.ErrChangeRequestExists of GitHub.
+var ErrPRExists = provider.ErrChangeRequestExists
+
+// ErrAutoMergeUnavailable is returned by EnableAutoMerge when GitHub refuses auto-merge as there is nothing to wait for.
+var ErrAutoMergeUnavailable = errors.New("auto-merge unavailable")
+
+// CreatePR opens a PR from head into base. It returns ErrPRExists if one is already open for head.
+func (c *Client) CreatePR(ctx context.Context, owner, repo, head, base, title, body string, draft bool) (*github.PullRequest, error) {
 	pr := &github.NewPullRequest{
 		Title: &title,
 		Head:  &head,
 		Base:  &base,
 		Body:  &body,
+		Draft: &draft,
+	}
+	pull, _, err := c.Client.PullRequests.Create(ctx, owner, repo, pr)
+	if isPRExists(err) {
+		return nil, fmt.Errorf("%w: %s", ErrPRExists, err)
 	}
-	pull, _, err := c.Client.PullRequests.Create(c.ctx, owner, repo, pr)
 	if err != nil {
 		return nil, err
 	}
 	return pull, nil
 }
 
-func (c *Client) MergePR(pr *github.PullRequest) error {
+// isPRExists returns true if the PR was not created because one is already open for its head branch.
+// GitHub reports it as a validation error of the PullRequest resource.
+func isPRExists(err error) bool {
+	var errResp *github.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Response == nil || errResp.Response.StatusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+	for _, e := range errResp.Errors {
+		if e.Resource == "PullRequest" && strings.HasPrefix(e.Message, "A pull request already exists") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) MergePR(ctx context.Context, pr *github.PullRequest, opts provider.MergeOpts) error {
 	owner, repo := GetOwnerAndRepo(pr)
 	num := pr.GetNumber()
-	_, _, err := c.PullRequests.Merge(c.ctx, owner, repo, num, "", &github.PullRequestOptions{
-		MergeMethod: "squash",
+	_, _, err := c.PullRequests.Merge(ctx, owner, repo, num, opts.CommitBody, &github.PullRequestOptions{
+		CommitTitle: opts.CommitTitle,
+		MergeMethod: opts.Method,
 	})
 	if err != nil {
 		return err
@@ -48,34 +81,293 @@ func (c *Client) MergePR(pr *github.PullRequest) error {
 	return nil
 }
 
-func (c *Client) Deploy(pr *github.PullRequest) error {
-	// sleep for 5 seconds before checking the status of the PR checks
-	time.Sleep(5 * time.Second)
-	err := retry.Do(
-		func() error { return c.WaitForPRChecks(pr) },
-		retry.Attempts(60),
-		retry.Delay(5*time.Second),
-		retry.DelayType(retry.FixedDelay),
-		retry.OnRetry(func(n uint, err error) {
-			actions.Infof("waiting for checks to pass: %v", err)
-		}),
-	)
+// UpdateChangeRequest implements provider.Provider.
+func (c *Client) UpdateChangeRequest(ctx context.Context, cr *provider.ChangeRequest, title, body string) error {
+	_, _, err := c.PullRequests.Edit(ctx, cr.Owner, cr.Repo, cr.Number, &github.PullRequest{
+		Title: &title,
+		Body:  &body,
+	})
+	return err
+}
+
+// RemoveLabels implements provider.Provider.
+func (c *Client) RemoveLabels(ctx context.Context, cr *provider.ChangeRequest, labels []string) error {
+	for _, label := range labels {
+		resp, err := c.Issues.RemoveLabelForIssue(ctx, cr.Owner, cr.Repo, cr.Number, label)
+		if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+			return fmt.Errorf("error removing label %s: %s", label, err)
+		}
+	}
+	return nil
+}
+
+// SetMetadata implements provider.Provider.
+func (c *Client) SetMetadata(ctx context.Context, cr *provider.ChangeRequest, meta *provider.Metadata) error {
+	if len(meta.Labels) > 0 {
+		_, _, err := c.Issues.AddLabelsToIssue(ctx, cr.Owner, cr.Repo, cr.Number, meta.Labels)
+		if err != nil {
+			return fmt.Errorf("error adding labels: %s", err)
+		}
+	}
+	if len(meta.Reviewers) > 0 || len(meta.TeamReviewers) > 0 {
+		_, _, err := c.PullRequests.RequestReviewers(ctx, cr.Owner, cr.Repo, cr.Number, github.ReviewersRequest{
+			Reviewers:     meta.Reviewers,
+			TeamReviewers: meta.TeamReviewers,
+		})
+		if err != nil {
+			return fmt.Errorf("error requesting reviewers: %s", err)
+		}
+	}
+	if len(meta.Assignees) > 0 {
+		_, _, err := c.Issues.AddAssignees(ctx, cr.Owner, cr.Repo, cr.Number, meta.Assignees)
+		if err != nil {
+			return fmt.Errorf("error adding assignees: %s", err)
+		}
+	}
+	return nil
+}
+
+// ValidateMergeMethod implements provider.Provider.
+func (c *Client) ValidateMergeMethod(ctx context.Context, owner, repo, method string) error {
+	r, _, err := c.Repositories.Get(ctx, owner, repo)
 	if err != nil {
 		return err
 	}
+	allowed := map[string]*bool{
+		config.MergeMethodMerge:  r.AllowMergeCommit,
+		config.MergeMethodSquash: r.AllowSquashMerge,
+		config.MergeMethodRebase: r.AllowRebaseMerge,
+	}
+	if allowed[method] == nil {
+		actions.Warningf("unable to read the allowed merge methods of %s/%s, skipping validation", owner, repo)
+		return nil
+	}
+	if *allowed[method] {
+		return nil
+	}
+	methods := []string{}
+	for _, m := range []string{config.MergeMethodMerge, config.MergeMethodSquash, config.MergeMethodRebase} {
+		if allowed[m] != nil && *allowed[m] {
+			methods = append(methods, m)
+		}
+	}
+	return fmt.Errorf("merge method %s is not allowed in %s/%s, allowed methods: %s", method, owner, repo, strings.Join(methods, ", "))
+}
+
+const enableAutoMergeMutation = `mutation($id: ID!, $method: PullRequestMergeMethod!, $headline: String, $body: String) {
+  enablePullRequestAutoMerge(input: {pullRequestId: $id, mergeMethod: $method, commitHeadline: $headline, commitBody: $body}) {
+    pullRequest { number }
+  }
+}`
+
+const enqueueMutation = `mutation($id: ID!) {
+  enqueuePullRequest(input: {pullRequestId: $id}) {
+    mergeQueueEntry { position }
+  }
+}`
+
+const markReadyMutation = `mutation($id: ID!) {
+  markPullRequestReadyForReview(input: {pullRequestId: $id}) {
+    pullRequest { number }
+  }
+}`
+
+// EnableAutoMerge enables GitHub's native auto-merge on the PR, which merges it once its
+// requirements are met. On branches with a merge queue, the PR is queued once it is ready.
+// It returns ErrAutoMergeUnavailable when GitHub has no requirement to wait for, as the PR is
+// already mergeable or the base branch has no protection rules.
+func (c *Client) EnableAutoMerge(ctx context.Context, pr *github.PullRequest, opts provider.MergeOpts) error {
+	vars := map[string]interface{}{
+		"id":     pr.GetNodeID(),
+		"method": strings.ToUpper(opts.Method),
+	}
+	if opts.CommitTitle != "" {
+		vars["headline"] = opts.CommitTitle
+	}
+	if opts.CommitBody != "" {
+		vars["body"] = opts.CommitBody
+	}
+	err := c.GraphQL(ctx, enableAutoMergeMutation, vars, nil)
+	if isAutoMergeUnavailable(err) {
+		return fmt.Errorf("%w: %s", ErrAutoMergeUnavailable, err)
+	}
+	return err
+}
 
-	err = retry.Do(
-		func() error { return c.MergePR(pr) },
-		retry.Attempts(24),
-		retry.Delay(5*time.Second),
-		retry.DelayType(retry.FixedDelay),
-		retry.OnRetry(func(n uint, err error) {
-			actions.Infof("attempt: %d to merge PR: %v", n, err)
-		}),
-	)
+// isAutoMergeUnavailable returns true if the error of enablePullRequestAutoMerge means that the PR can be merged right away.
+func isAutoMergeUnavailable(err error) bool {
+	var gqlErr *GraphQLError
+	if !errors.As(err, &gqlErr) {
+		return false
+	}
+	for _, msg := range gqlErr.Messages {
+		msg = strings.ToLower(msg)
+		if strings.Contains(msg, "is in clean status") || strings.Contains(msg, "is in unstable status") ||
+			strings.Contains(msg, "protected branch rules not configured") {
+			return true
+		}
+	}
+	return false
+}
 
+// EnqueuePR adds the PR to the merge queue of its base branch.
+func (c *Client) EnqueuePR(ctx context.Context, pr *github.PullRequest) error {
+	return c.GraphQL(ctx, enqueueMutation, map[string]interface{}{
+		"id": pr.GetNodeID(),
+	}, nil)
+}
+
+// PRMerged returns an error until the PR is merged.
+func (c *Client) PRMerged(ctx context.Context, pr *github.PullRequest) error {
+	owner, repo := GetOwnerAndRepo(pr)
+	p, _, err := c.PullRequests.Get(conditional(ctx), owner, repo, pr.GetNumber())
 	if err != nil {
 		return err
 	}
+	if !p.GetMerged() {
+		return fmt.Errorf("PR #%d is not merged yet", pr.GetNumber())
+	}
 	return nil
 }
+
+// Deploy merges the PR once the selected checks pass.
+// In the direct merge mode the tool waits for the checks and merges the PR itself. In the auto and
+// queue modes GitHub merges the PR, and the tool only waits for it when WaitForMerged is set.
+func (c *Client) Deploy(ctx context.Context, pr *github.PullRequest, opts *provider.DeployOpts) error {
+	owner, repo := GetOwnerAndRepo(pr)
+	checks, err := c.ResolveChecks(ctx, owner, repo, pr.GetBase().GetRef(), opts.Checks)
+	if err != nil {
+		return err
+	}
+	waitForChecks := func() error { return c.WaitForPRChecks(ctx, pr, checks) }
+
+	switch opts.MergeMode {
+	case config.MergeModeDirect, "":
+		return provider.WaitAndMerge(ctx, opts, waitForChecks, func() error { return c.MergePR(ctx, pr, opts.Merge) })
+	case config.MergeModeAuto:
+		actions.Infof("enabling auto-merge for PR #%d ...", pr.GetNumber())
+		err = c.EnableAutoMerge(ctx, pr, opts.Merge)
+		if errors.Is(err, ErrAutoMergeUnavailable) {
+			actions.Infof("auto-merge is not available for PR #%d (%s), merging it directly ...", pr.GetNumber(), err)
+			return provider.WaitAndMerge(ctx, opts, waitForChecks, func() error { return c.MergePR(ctx, pr, opts.Merge) })
+		}
+	case config.MergeModeQueue:
+		actions.Infof("adding PR #%d to the merge queue ...", pr.GetNumber())
+		err = c.EnqueuePR(ctx, pr)
+	default:
+		return fmt.Errorf("invalid merge mode: %s", opts.MergeMode)
+	}
+	if err != nil {
+		return err
+	}
+	if !opts.WaitForMerged {
+		return nil
+	}
+	actions.Infof("waiting for PR #%d to be merged ...", pr.GetNumber())
+	mergedOpts := *opts
+	mergedOpts.Wait = opts.Wait.WithDefaults()
+	mergedOpts.Wait.MergeTimeout = mergedOpts.Wait.MergedTimeout
+	return provider.WaitAndMerge(ctx, &mergedOpts, waitForChecks, func() error { return c.PRMerged(ctx, pr) })
+}
+
+// CreateChangeRequest implements provider.Provider.
+func (c *Client) CreateChangeRequest(ctx context.Context, owner, repo, head, base, title, body string, draft bool) (*provider.ChangeRequest, error) {
+	pr, err := c.CreatePR(ctx, owner, repo, head, base, title, body, draft)
+	if err != nil {
+		return nil, err
+	}
+	return changeRequest(pr), nil
+}
+
+// GetChangeRequest implements provider.Provider.
+func (c *Client) GetChangeRequest(ctx context.Context, owner, repo, head string) (*provider.ChangeRequest, error) {
+	pr, err := c.GetPR(ctx, owner, repo, head)
+	if err != nil {
+		return nil, err
+	}
+	return changeRequest(pr), nil
+}
+
+// DeployChangeRequest implements provider.Provider.
+func (c *Client) DeployChangeRequest(ctx context.Context, cr *provider.ChangeRequest, opts *provider.DeployOpts) error {
+	pr, _, err := c.PullRequests.Get(ctx, cr.Owner, cr.Repo, cr.Number)
+	if err != nil {
+		return err
+	}
+	return c.Deploy(ctx, pr, opts)
+}
+
+// WaitForChecks implements provider.Provider.
+func (c *Client) WaitForChecks(ctx context.Context, cr *provider.ChangeRequest, checks config.Checks, wait config.Wait) error {
+	pr, _, err := c.PullRequests.Get(ctx, cr.Owner, cr.Repo, cr.Number)
+	if err != nil {
+		return err
+	}
+	checks, err = c.ResolveChecks(ctx, cr.Owner, cr.Repo, pr.GetBase().GetRef(), checks)
+	if err != nil {
+		return err
+	}
+	return provider.PollChecks(ctx, wait, func() error { return c.WaitForPRChecks(ctx, pr, checks) })
+}
+
+// MarkReady implements provider.Provider.
+func (c *Client) MarkReady(ctx context.Context, cr *provider.ChangeRequest) error {
+	pr, _, err := c.PullRequests.Get(ctx, cr.Owner, cr.Repo, cr.Number)
+	if err != nil {
+		return err
+	}
+	if !pr.GetDraft() {
+		return nil
+	}
+	return c.GraphQL(ctx, markReadyMutation, map[string]interface{}{
+		"id": pr.GetNodeID(),
+	}, nil)
+}
+
+func changeRequest(pr *github.PullRequest) *provider.ChangeRequest {
+	owner, repo := GetOwnerAndRepo(pr)
+	return &provider.ChangeRequest{
+		Owner:  owner,
+		Repo:   repo,
+		Number: pr.GetNumber(),
+		URL:    pr.GetHTMLURL(),
+		Head:   pr.GetHead().GetRef(),
+		Base:   pr.GetBase().GetRef(),
+		Title:  pr.GetTitle(),
+		Body:   pr.GetBody(),
+		Draft:  pr.GetDraft(),
+	}
+}
+
+// ListChangeRequests implements provider.Provider.
+func (c *Client) ListChangeRequests(ctx context.Context, owner, repo, prefix string) ([]*provider.ChangeRequest, error) {
+	crs := []*provider.ChangeRequest{}
+	opts := &github.PullRequestListOptions{State: "open", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		prs, resp, err := c.PullRequests.List(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			if strings.HasPrefix(pr.GetHead().GetRef(), prefix) && pr.GetHead().GetRepo().GetFullName() == pr.GetBase().GetRepo().GetFullName() {
+				crs = append(crs, changeRequest(pr))
+			}
+		}
+		if resp.NextPage == 0 {
+			return crs, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// CloseChangeRequest implements provider.Provider.
+func (c *Client) CloseChangeRequest(ctx context.Context, cr *provider.ChangeRequest, comment string) error {
+	_, _, err := c.Issues.CreateComment(ctx, cr.Owner, cr.Repo, cr.Number, &github.IssueComment{Body: &comment})
+	if err != nil {
+		return fmt.Errorf("error commenting: %s", err)
+	}
+	_, _, err = c.PullRequests.Edit(ctx, cr.Owner, cr.Repo, cr.Number, &github.PullRequest{
+		State: github.String("closed"),
+	})
+	return err
+}
@@ -0,0 +1,266 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	actions "github.com/sethvargo/go-githubactions"
+)
+
+const (
+	// minRemaining is the remaining rate limit budget below which requests are queued until the reset.
+	minRemaining = 10
+	// maxRateLimitRetries is the number of times a rate limited request is retried.
+	maxRateLimitRetries = 3
+	// maxRateLimitWait is the longest wait before a retry, longer waits return the rate limited response.
+	maxRateLimitWait = 15 * time.Minute
+	// secondaryRateLimitWait is waited after a secondary rate limit without a Retry-After header.
+	secondaryRateLimitWait = time.Minute
+)
+
+type conditionalKey struct{}
+
+// conditional marks the requests of a context to be sent as conditional requests, for polling.
+func conditional(ctx context.Context) context.Context {
+	return context.WithValue(ctx, conditionalKey{}, true)
+}
+
+// budget is the rate limit budget of one rate limit resource, such as core, search or graphql.
+type budget struct {
+	remaining int
+	reset     time.Time
+}
+
+type cachedResponse struct {
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+// rateLimitTransport waits for the GitHub rate limits instead of failing.
+// Requests are queued until the reset once the remaining budget of their resource is low, and rate limited requests are
+// retried after their Retry-After or X-RateLimit-Reset time. GET requests of conditional contexts are sent
+// with the ETag of the previous response, a 304 Not Modified response is answered from the cache and
+// doesn't count against the rate limit.
+type rateLimitTransport struct {
+	base http.RoundTripper
+
+	mu      sync.Mutex
+	budgets map[string]*budget
+	cache   map[string]*cachedResponse
+}
+
+func newRateLimitTransport(base http.RoundTripper) *rateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitTransport{
+		base:    base,
+		budgets: map[string]*budget{},
+		cache:   map[string]*cachedResponse{},
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.queue(req)
+
+	key := req.URL.String()
+	isConditional := req.Method == http.MethodGet && req.Context().Value(conditionalKey{}) != nil
+	var cached *cachedResponse
+	if isConditional {
+		t.mu.Lock()
+		cached = t.cache[key]
+		t.mu.Unlock()
+		if cached != nil {
+			req = req.Clone(req.Context())
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		t.update(req, resp.Header)
+
+		wait, limited := rateLimitWait(resp)
+		if !limited || attempt >= maxRateLimitRetries || wait > maxRateLimitWait || (req.Body != nil && req.GetBody == nil) {
+			if !limited {
+				if err := t.waitExhausted(req, resp); err != nil {
+					return nil, err
+				}
+			}
+			if isConditional {
+				return t.conditionalResponse(key, cached, resp)
+			}
+			return resp, nil
+		}
+
+		actions.Infof("GitHub API rate limit hit, waiting %s before retrying %s %s", wait.Round(time.Second), req.Method, req.URL.Path)
+		resp.Body.Close()
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// queue blocks while the remaining rate limit budget of the resource of the request is low, until it resets.
+// The wait is computed under the lock and slept without it, so that other requests and responses go on.
+func (t *rateLimitTransport) queue(req *http.Request) {
+	resource := rateLimitResource(req)
+	t.mu.Lock()
+	b := t.budgets[resource]
+	var remaining int
+	var wait time.Duration
+	if b != nil && b.remaining < minRemaining {
+		remaining, wait = b.remaining, time.Until(b.reset)
+	}
+	t.mu.Unlock()
+	if wait <= 0 || wait > maxRateLimitWait {
+		return
+	}
+	actions.Infof("GitHub API %s rate limit budget is low (%d remaining), waiting %s for the reset", resource, remaining, wait.Round(time.Second))
+	select {
+	case <-time.After(wait):
+	case <-req.Context().Done():
+	}
+}
+
+// waitExhausted waits for the reset before returning a response which used up the rate limit budget.
+// go-github refuses requests by itself while the last response reported no remaining budget, so the
+// reset has to be over by the time it sees the response for the next requests to be queued instead.
+func (t *rateLimitTransport) waitExhausted(req *http.Request, resp *http.Response) error {
+	if resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		return nil
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return nil
+	}
+	wait := time.Until(time.Unix(reset, 0)) + time.Second
+	if wait <= 0 || wait > maxRateLimitWait {
+		return nil
+	}
+	actions.Infof("GitHub API rate limit budget is used up, waiting %s for the reset", wait.Round(time.Second))
+	select {
+	case <-time.After(wait):
+	case <-req.Context().Done():
+		resp.Body.Close()
+		return req.Context().Err()
+	}
+	return nil
+}
+
+// update records the rate limit budget of a response, for the resource it reports.
+func (t *rateLimitTransport) update(req *http.Request, h http.Header) {
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	resource := h.Get("X-RateLimit-Resource")
+	if resource == "" {
+		resource = rateLimitResource(req)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.budgets[resource] = &budget{remaining: remaining, reset: time.Unix(reset, 0)}
+}
+
+// rateLimitResource returns the rate limit resource a request counts against, as its response reports
+// in the X-RateLimit-Resource header.
+func rateLimitResource(req *http.Request) string {
+	p := strings.TrimPrefix(req.URL.Path, "/api/v3")
+	switch {
+	case p == "/graphql" || p == "/api/graphql":
+		return "graphql"
+	case strings.HasPrefix(p, "/search/code"):
+		return "code_search"
+	case strings.HasPrefix(p, "/search/"):
+		return "search"
+	}
+	return "core"
+}
+
+// conditionalResponse caches a successful response with an ETag, and turns a 304 Not Modified
+// response into the cached response.
+func (t *rateLimitTransport) conditionalResponse(key string, cached *cachedResponse, resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		header := cached.header.Clone()
+		for k, v := range resp.Header {
+			if strings.HasPrefix(k, "X-Ratelimit-") {
+				header[k] = v
+			}
+		}
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+		resp.Header = header
+		resp.Body = io.NopCloser(bytes.NewReader(cached.body))
+		resp.ContentLength = int64(len(cached.body))
+		return resp, nil
+	}
+
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	t.mu.Lock()
+	t.cache[key] = &cachedResponse{etag: etag, header: resp.Header.Clone(), body: body}
+	t.mu.Unlock()
+	return resp, nil
+}
+
+// rateLimitWait returns how long to wait before retrying a rate limited response.
+func rateLimitWait(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if s := resp.Header.Get("Retry-After"); s != "" {
+		if seconds, err := strconv.Atoi(s); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Until(time.Unix(reset, 0)) + time.Second, true
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return secondaryRateLimitWait, true
+	}
+	// secondary rate limits without a Retry-After header are only told apart by their message.
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err == nil && strings.Contains(strings.ToLower(string(body)), "secondary rate limit") {
+		return secondaryRateLimitWait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,76 @@
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	actions "github.com/sethvargo/go-githubactions"
+
+	"gitops-actions/internal/provider"
+	"gitops-actions/internal/restapi"
+)
+
+// Access levels of GitLab project members.
+const (
+	reporterAccess  = 20
+	developerAccess = 30
+)
+
+// GetAccess implements provider.Provider.
+// The access is the highest of the project and group access levels of the token user: developers
+// can push branches and open merge requests, reporters can read pipelines.
+func (c *Client) GetAccess(ctx context.Context, owner, repo string) (*provider.Access, error) {
+	type accessLevel struct {
+		AccessLevel int `json:"access_level"`
+	}
+	p := &struct {
+		Permissions struct {
+			ProjectAccess *accessLevel `json:"project_access"`
+			GroupAccess   *accessLevel `json:"group_access"`
+		} `json:"permissions"`
+	}{}
+	err := c.rest.Do(ctx, http.MethodGet, projectPath(owner, repo), nil, p)
+	if err != nil {
+		return nil, err
+	}
+	access := &provider.Access{Read: true}
+	level := 0
+	for _, a := range []*accessLevel{p.Permissions.ProjectAccess, p.Permissions.GroupAccess} {
+		if a != nil && a.AccessLevel > level {
+			level = a.AccessLevel
+		}
+	}
+	if p.Permissions.ProjectAccess == nil && p.Permissions.GroupAccess == nil {
+		actions.Warningf("unable to read the access level to %s/%s, assuming full access", owner, repo)
+		level = developerAccess
+	}
+	access.Push = level >= developerAccess
+	access.ChangeRequests = level >= developerAccess
+	access.Checks = level >= reporterAccess
+	return access, nil
+}
+
+// BranchExists implements provider.Provider.
+func (c *Client) BranchExists(ctx context.Context, owner, repo, branch string) (bool, error) {
+	err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/repository/branches/%s", projectPath(owner, repo), url.PathEscape(branch)), nil, nil)
+	return restapi.Exists(err)
+}
+
+// PathExists implements provider.Provider.
+// Files are looked up with the files API, directories as a non-empty tree.
+func (c *Client) PathExists(ctx context.Context, owner, repo, ref, path string) (bool, error) {
+	q := url.Values{"ref": {ref}}
+	ok, err := restapi.Exists(c.rest.Do(ctx, http.MethodHead, fmt.Sprintf("%s/repository/files/%s?%s", projectPath(owner, repo), url.PathEscape(path), q.Encode()), nil, nil))
+	if ok || err != nil {
+		return ok, err
+	}
+
+	tree := []struct {
+		Path string `json:"path"`
+	}{}
+	q = url.Values{"ref": {ref}, "path": {path}, "per_page": {"1"}}
+	ok, err = restapi.Exists(c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/repository/tree?%s", projectPath(owner, repo), q.Encode()), nil, &tree))
+	return ok && len(tree) > 0, err
+}
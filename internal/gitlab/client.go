@@ -0,0 +1,38 @@
+package gitlab
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gitops-actions/internal/restapi"
+)
+
+// Client is a minimal client for the GitLab REST API v4.
+type Client struct {
+	rest *restapi.Client
+}
+
+type ClientOpts struct {
+	Token, BaseURL string
+}
+
+func NewClient(opts *ClientOpts) (*Client, error) {
+	if opts.Token == "" {
+		return nil, fmt.Errorf("a token is required for gitlab")
+	}
+	return &Client{rest: &restapi.Client{
+		HTTP:       http.DefaultClient,
+		Name:       "gitlab",
+		BaseURL:    fmt.Sprintf("%s/api/v4", strings.TrimSuffix(opts.BaseURL, "/")),
+		AuthHeader: "PRIVATE-TOKEN",
+		AuthValue:  opts.Token,
+	}}, nil
+}
+
+// projectPath returns the path of the project API endpoint for owner/repo.
+// The owner can be a nested group, e.g. group/subgroup.
+func projectPath(owner, repo string) string {
+	return fmt.Sprintf("/projects/%s", url.PathEscape(fmt.Sprintf("%s/%s", owner, repo)))
+}
@@ -0,0 +1,416 @@
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	actions "github.com/sethvargo/go-githubactions"
+
+	"gitops-actions/internal/config"
+	"gitops-actions/internal/provider"
+	"gitops-actions/internal/restapi"
+)
+
+type MergeRequest struct {
+	IID          int    `json:"iid"`
+	Title        string `json:"title"`
+	Description  string `json:"description"`
+	WebURL       string `json:"web_url"`
+	SourceBranch string `json:"source_branch"`
+	TargetBranch string `json:"target_branch"`
+	State        string `json:"state"`
+	Draft        bool   `json:"draft"`
+	HeadPipeline *struct {
+		ID     int    `json:"id"`
+		Status string `json:"status"`
+	} `json:"head_pipeline"`
+}
+
+type approvals struct {
+	Approved      bool `json:"approved"`
+	ApprovalsLeft int  `json:"approvals_left"`
+}
+
+// draftPrefix marks a merge request as a draft through its title.
+const draftPrefix = "Draft: "
+
+var (
+	failedPipelineStatuses  = []string{"failed", "canceled"}
+	successPipelineStatuses = []string{"success", "skipped"}
+)
+
+func (c *Client) GetMR(ctx context.Context, owner, repo, branch string) (*MergeRequest, error) {
+	mrs := []*MergeRequest{}
+	q := url.Values{"source_branch": {branch}, "state": {"opened"}}
+	err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/merge_requests?%s", projectPath(owner, repo), q.Encode()), nil, &mrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(mrs) == 0 {
+		return nil, fmt.Errorf("no MR found for branch %s", branch)
+	}
+	return mrs[0], nil
+}
+
+func (c *Client) CreateMR(ctx context.Context, owner, repo, head, base, title, body string, draft bool) (*MergeRequest, error) {
+	if draft {
+		title = draftPrefix + title
+	}
+	mr := &MergeRequest{}
+	err := c.rest.Do(ctx, http.MethodPost, fmt.Sprintf("%s/merge_requests", projectPath(owner, repo)), map[string]string{
+		"source_branch": head,
+		"target_branch": base,
+		"title":         title,
+		"description":   body,
+	}, mr)
+	if err != nil {
+		return nil, err
+	}
+	return mr, nil
+}
+
+// ApprovalErr returns ErrApprovalRequired until the MR is approved.
+func (c *Client) ApprovalErr(ctx context.Context, owner, repo string, iid int) error {
+	a := &approvals{}
+	err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/merge_requests/%d/approvals", projectPath(owner, repo), iid), nil, a)
+	if err != nil {
+		return err
+	}
+	if !a.Approved || a.ApprovalsLeft > 0 {
+		actions.Infof("MR is waiting for %d more approvals. retrying...", a.ApprovalsLeft)
+		return fmt.Errorf("%w: %d more approvals needed", provider.ErrApprovalRequired, a.ApprovalsLeft)
+	}
+	return nil
+}
+
+// PipelineErr returns an error unless the head pipeline of the MR succeeded.
+func (c *Client) PipelineErr(ctx context.Context, owner, repo string, iid int) error {
+	mr := &MergeRequest{}
+	err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/merge_requests/%d", projectPath(owner, repo), iid), nil, mr)
+	if err != nil {
+		return err
+	}
+	if mr.HeadPipeline == nil {
+		actions.Infof("No pipeline found for MR. This is likely due to a delay in the pipeline being created. retrying...")
+		return &provider.CheckStateError{State: provider.CheckStateNotFound}
+	}
+	actions.Debugf("Pipeline: %d, status: %s", mr.HeadPipeline.ID, mr.HeadPipeline.Status)
+	if slices.Contains(failedPipelineStatuses, mr.HeadPipeline.Status) {
+		actions.Infof("pipeline %d failed.", mr.HeadPipeline.ID)
+		return &provider.CheckStateError{
+			State:  provider.CheckStateFailed,
+			Checks: []string{fmt.Sprintf("pipeline %d (%s)", mr.HeadPipeline.ID, mr.HeadPipeline.Status)},
+		}
+	}
+	if !slices.Contains(successPipelineStatuses, mr.HeadPipeline.Status) {
+		actions.Infof("pipeline %d has not completed yet. retrying...", mr.HeadPipeline.ID)
+		return &provider.CheckStateError{
+			State:  provider.CheckStatePending,
+			Checks: []string{fmt.Sprintf("pipeline %d", mr.HeadPipeline.ID)},
+		}
+	}
+	return nil
+}
+
+// MergeMR merges the MR. The rebase method relies on the merge method of the project,
+// which has to be set to fast-forward or semi-linear history.
+func (c *Client) MergeMR(ctx context.Context, owner, repo string, iid int, opts provider.MergeOpts) error {
+	squash := opts.Method == config.MergeMethodSquash
+	req := map[string]interface{}{
+		"squash": squash,
+	}
+	if msg := commitMessage(opts); msg != "" {
+		if squash {
+			req["squash_commit_message"] = msg
+		} else {
+			req["merge_commit_message"] = msg
+		}
+	}
+	return c.rest.Do(ctx, http.MethodPut, fmt.Sprintf("%s/merge_requests/%d/merge", projectPath(owner, repo), iid), req, nil)
+}
+
+// UpdateChangeRequest implements provider.Provider.
+// Draft merge requests keep the draft prefix of their title.
+func (c *Client) UpdateChangeRequest(ctx context.Context, cr *provider.ChangeRequest, title, body string) error {
+	if cr.Draft {
+		title = draftPrefix + title
+	}
+	return c.rest.Do(ctx, http.MethodPut, fmt.Sprintf("%s/merge_requests/%d", projectPath(cr.Owner, cr.Repo), cr.Number), map[string]string{
+		"title":       title,
+		"description": body,
+	}, nil)
+}
+
+// RemoveLabels implements provider.Provider.
+func (c *Client) RemoveLabels(ctx context.Context, cr *provider.ChangeRequest, labels []string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	return c.rest.Do(ctx, http.MethodPut, fmt.Sprintf("%s/merge_requests/%d", projectPath(cr.Owner, cr.Repo), cr.Number), map[string]string{
+		"remove_labels": strings.Join(labels, ","),
+	}, nil)
+}
+
+// SetMetadata implements provider.Provider.
+// Team reviewers are not supported by GitLab and are ignored.
+func (c *Client) SetMetadata(ctx context.Context, cr *provider.ChangeRequest, meta *provider.Metadata) error {
+	if len(meta.TeamReviewers) > 0 {
+		actions.Warningf("team reviewers are not supported for gitlab, ignoring %s", strings.Join(meta.TeamReviewers, ", "))
+	}
+	req := map[string]interface{}{}
+	if len(meta.Labels) > 0 {
+		req["add_labels"] = strings.Join(meta.Labels, ",")
+	}
+	if len(meta.Reviewers) > 0 {
+		ids, err := c.userIDs(ctx, meta.Reviewers)
+		if err != nil {
+			return err
+		}
+		req["reviewer_ids"] = ids
+	}
+	if len(meta.Assignees) > 0 {
+		ids, err := c.userIDs(ctx, meta.Assignees)
+		if err != nil {
+			return err
+		}
+		req["assignee_ids"] = ids
+	}
+	if len(req) == 0 {
+		return nil
+	}
+	return c.rest.Do(ctx, http.MethodPut, fmt.Sprintf("%s/merge_requests/%d", projectPath(cr.Owner, cr.Repo), cr.Number), req, nil)
+}
+
+// userIDs looks up the IDs of the given usernames.
+func (c *Client) userIDs(ctx context.Context, usernames []string) ([]int, error) {
+	ids := []int{}
+	for _, username := range usernames {
+		users := []struct {
+			ID int `json:"id"`
+		}{}
+		err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("/users?%s", url.Values{"username": {username}}.Encode()), nil, &users)
+		if err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			return nil, fmt.Errorf("user %s not found", username)
+		}
+		ids = append(ids, users[0].ID)
+	}
+	return ids, nil
+}
+
+// ValidateMergeMethod implements provider.Provider.
+func (c *Client) ValidateMergeMethod(ctx context.Context, owner, repo, method string) error {
+	p := &struct {
+		MergeMethod  string `json:"merge_method"`
+		SquashOption string `json:"squash_option"`
+	}{}
+	err := c.rest.Do(ctx, http.MethodGet, projectPath(owner, repo), nil, p)
+	if err != nil {
+		return err
+	}
+	switch {
+	case method == config.MergeMethodSquash && p.SquashOption == "never":
+		return fmt.Errorf("merge method squash is not allowed in %s/%s, squashing is disabled", owner, repo)
+	case method != config.MergeMethodSquash && p.SquashOption == "always":
+		return fmt.Errorf("merge method %s is not allowed in %s/%s, squashing is required", method, owner, repo)
+	case method == config.MergeMethodRebase && p.MergeMethod == "merge":
+		return fmt.Errorf("merge method rebase is not allowed in %s/%s, the project merge method creates merge commits", owner, repo)
+	}
+	return nil
+}
+
+func commitMessage(opts provider.MergeOpts) string {
+	if opts.CommitBody == "" {
+		return opts.CommitTitle
+	}
+	return fmt.Sprintf("%s\n\n%s", opts.CommitTitle, opts.CommitBody)
+}
+
+// CreateChangeRequest implements provider.Provider.
+func (c *Client) CreateChangeRequest(ctx context.Context, owner, repo, head, base, title, body string, draft bool) (*provider.ChangeRequest, error) {
+	mr, err := c.CreateMR(ctx, owner, repo, head, base, title, body, draft)
+	if restapi.HasStatus(err, http.StatusConflict) {
+		return nil, fmt.Errorf("%w: %s", provider.ErrChangeRequestExists, err)
+	} else if err != nil {
+		return nil, err
+	}
+	return changeRequest(owner, repo, mr), nil
+}
+
+// GetChangeRequest implements provider.Provider.
+func (c *Client) GetChangeRequest(ctx context.Context, owner, repo, head string) (*provider.ChangeRequest, error) {
+	mr, err := c.GetMR(ctx, owner, repo, head)
+	if err != nil {
+		return nil, err
+	}
+	return changeRequest(owner, repo, mr), nil
+}
+
+// DeployChangeRequest implements provider.Provider.
+// The merge request is gated by its head pipeline and approvals, check selection is not supported.
+func (c *Client) DeployChangeRequest(ctx context.Context, cr *provider.ChangeRequest, opts *provider.DeployOpts) error {
+	if !opts.Checks.IsEmpty() {
+		actions.Warningf("check selection is not supported for gitlab, waiting for the head pipeline instead")
+	}
+	return provider.WaitApproveAndMerge(ctx, opts,
+		func() error { return c.PipelineErr(ctx, cr.Owner, cr.Repo, cr.Number) },
+		func() error { return c.ApprovalErr(ctx, cr.Owner, cr.Repo, cr.Number) },
+		func() error { return c.MergeMR(ctx, cr.Owner, cr.Repo, cr.Number, opts.Merge) },
+	)
+}
+
+// WaitForChecks implements provider.Provider.
+// It waits for the head pipeline of the merge request, check selection is not supported.
+func (c *Client) WaitForChecks(ctx context.Context, cr *provider.ChangeRequest, checks config.Checks, wait config.Wait) error {
+	if !checks.IsEmpty() {
+		actions.Warningf("check selection is not supported for gitlab, waiting for the head pipeline instead")
+	}
+	return provider.PollChecks(ctx, wait, func() error { return c.PipelineErr(ctx, cr.Owner, cr.Repo, cr.Number) })
+}
+
+// MarkReady implements provider.Provider.
+func (c *Client) MarkReady(ctx context.Context, cr *provider.ChangeRequest) error {
+	mr := &MergeRequest{}
+	err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/merge_requests/%d", projectPath(cr.Owner, cr.Repo), cr.Number), nil, mr)
+	if err != nil {
+		return err
+	}
+	if !mr.Draft {
+		return nil
+	}
+	return c.rest.Do(ctx, http.MethodPut, fmt.Sprintf("%s/merge_requests/%d", projectPath(cr.Owner, cr.Repo), cr.Number), map[string]string{
+		"title": trimDraft(mr.Title),
+	}, nil)
+}
+
+// trimDraft removes the prefixes GitLab recognises as marking a draft from the title.
+func trimDraft(title string) string {
+	for _, prefix := range []string{"Draft:", "[Draft]", "(Draft)"} {
+		if len(title) >= len(prefix) && strings.EqualFold(title[:len(prefix)], prefix) {
+			return strings.TrimSpace(title[len(prefix):])
+		}
+	}
+	return title
+}
+
+func changeRequest(owner, repo string, mr *MergeRequest) *provider.ChangeRequest {
+	return &provider.ChangeRequest{
+		Owner:  owner,
+		Repo:   repo,
+		Number: mr.IID,
+		URL:    mr.WebURL,
+		Head:   mr.SourceBranch,
+		Base:   mr.TargetBranch,
+		Title:  trimDraft(mr.Title),
+		Body:   mr.Description,
+		Draft:  mr.Draft,
+	}
+}
+
+// UpsertComment implements provider.Provider.
+func (c *Client) UpsertComment(ctx context.Context, cr *provider.ChangeRequest, marker, body string) error {
+	notesPath := fmt.Sprintf("%s/merge_requests/%d/notes", projectPath(cr.Owner, cr.Repo), cr.Number)
+	for page := 1; ; page++ {
+		notes := []struct {
+			ID     int    `json:"id"`
+			Body   string `json:"body"`
+			System bool   `json:"system"`
+		}{}
+		err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s?per_page=100&page=%d", notesPath, page), nil, &notes)
+		if err != nil {
+			return fmt.Errorf("error listing notes: %s", err)
+		}
+		if len(notes) == 0 {
+			break
+		}
+		for _, n := range notes {
+			if n.System || !strings.Contains(n.Body, marker) {
+				continue
+			}
+			err = c.rest.Do(ctx, http.MethodPut, fmt.Sprintf("%s/%d", notesPath, n.ID), map[string]string{"body": body}, nil)
+			if err != nil {
+				return fmt.Errorf("error updating note: %s", err)
+			}
+			return nil
+		}
+	}
+
+	err := c.rest.Do(ctx, http.MethodPost, notesPath, map[string]string{"body": body}, nil)
+	if err != nil {
+		return fmt.Errorf("error creating note: %s", err)
+	}
+	return nil
+}
+
+// ListChangeRequests implements provider.Provider.
+func (c *Client) ListChangeRequests(ctx context.Context, owner, repo, prefix string) ([]*provider.ChangeRequest, error) {
+	crs := []*provider.ChangeRequest{}
+	for page := 1; ; page++ {
+		mrs := []*MergeRequest{}
+		err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/merge_requests?state=opened&per_page=100&page=%d", projectPath(owner, repo), page), nil, &mrs)
+		if err != nil {
+			return nil, err
+		}
+		if len(mrs) == 0 {
+			return crs, nil
+		}
+		for _, mr := range mrs {
+			if strings.HasPrefix(mr.SourceBranch, prefix) {
+				crs = append(crs, changeRequest(owner, repo, mr))
+			}
+		}
+	}
+}
+
+// CloseChangeRequest implements provider.Provider.
+func (c *Client) CloseChangeRequest(ctx context.Context, cr *provider.ChangeRequest, comment string) error {
+	err := c.rest.Do(ctx, http.MethodPost, fmt.Sprintf("%s/merge_requests/%d/notes", projectPath(cr.Owner, cr.Repo), cr.Number), map[string]string{"body": comment}, nil)
+	if err != nil {
+		return fmt.Errorf("error commenting: %s", err)
+	}
+	return c.rest.Do(ctx, http.MethodPut, fmt.Sprintf("%s/merge_requests/%d", projectPath(cr.Owner, cr.Repo), cr.Number), map[string]string{
+		"state_event": "close",
+	}, nil)
+}
+
+// ListBranches implements provider.Provider.
+func (c *Client) ListBranches(ctx context.Context, owner, repo, prefix string) ([]*provider.Branch, error) {
+	branches := []*provider.Branch{}
+	for page := 1; ; page++ {
+		bs := []struct {
+			Name   string `json:"name"`
+			Commit struct {
+				CommittedDate time.Time `json:"committed_date"`
+			} `json:"commit"`
+		}{}
+		q := url.Values{"search": {"^" + prefix}, "per_page": {"100"}, "page": {fmt.Sprint(page)}}
+		err := c.rest.Do(ctx, http.MethodGet, fmt.Sprintf("%s/repository/branches?%s", projectPath(owner, repo), q.Encode()), nil, &bs)
+		if err != nil {
+			return nil, err
+		}
+		if len(bs) == 0 {
+			return branches, nil
+		}
+		for _, b := range bs {
+			if strings.HasPrefix(b.Name, prefix) {
+				branches = append(branches, &provider.Branch{Name: b.Name, CommittedAt: b.Commit.CommittedDate})
+			}
+		}
+	}
+}
+
+// DeleteBranch implements provider.Provider.
+func (c *Client) DeleteBranch(ctx context.Context, owner, repo, branch string) error {
+	err := c.rest.Do(ctx, http.MethodDelete, fmt.Sprintf("%s/repository/branches/%s", projectPath(owner, repo), url.PathEscape(branch)), nil, nil)
+	if restapi.HasStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	historyMarker = "<!-- gitops-actions:history -->"
+	labelsMarker  = "<!-- gitops-actions:labels "
+	markerEnd     = " -->"
+	historyHeader = "| Value | Pushed at | Source |\n| --- | --- | --- |"
+)
+
+// HistoryEntry is a value pushed to the branch of a change request.
+type HistoryEntry struct {
+	Value    string
+	PushedAt time.Time
+	// Source is the URL of the workflow run which pushed the value, if known.
+	Source string
+}
+
+func (e HistoryEntry) row() string {
+	source := "-"
+	if e.Source != "" {
+		source = fmt.Sprintf("[run](%s)", e.Source)
+	}
+	return fmt.Sprintf("| `%s` | %s | %s |", e.Value, e.PushedAt.UTC().Format(time.RFC3339), source)
+}
+
+// ComposeBody returns the body of a change request, followed by the history of pushed values
+// and a hidden list of the labels managed by the tool.
+// The history is carried over from the previous body of the change request, if any.
+func ComposeBody(body, previous string, entry HistoryEntry, labels []string) string {
+	rows := historyRows(previous)
+	row := entry.row()
+	if len(rows) == 0 || historyValue(rows[len(rows)-1]) != historyValue(row) {
+		rows = append(rows, row)
+	}
+
+	b := strings.Builder{}
+	b.WriteString(strings.TrimSpace(body))
+	b.WriteString("\n\n")
+	b.WriteString(historyMarker)
+	b.WriteString("\n### Value history\n\n")
+	b.WriteString(historyHeader)
+	b.WriteString("\n")
+	b.WriteString(strings.Join(rows, "\n"))
+	b.WriteString("\n")
+	if len(labels) > 0 {
+		b.WriteString("\n")
+		b.WriteString(labelsMarker)
+		b.WriteString(strings.Join(labels, ","))
+		b.WriteString(markerEnd)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// ManagedLabels returns the labels the tool set on a change request, as recorded in its body.
+func ManagedLabels(body string) []string {
+	_, after, ok := strings.Cut(body, labelsMarker)
+	if !ok {
+		return nil
+	}
+	list, _, ok := strings.Cut(after, markerEnd)
+	if !ok || list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// historyRows returns the table rows of the history section of a body.
+func historyRows(body string) []string {
+	_, history, ok := strings.Cut(body, historyMarker)
+	if !ok {
+		return nil
+	}
+	rows := []string{}
+	for _, line := range strings.Split(history, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "| `") {
+			continue
+		}
+		rows = append(rows, line)
+	}
+	return rows
+}
+
+func historyValue(row string) string {
+	cells := strings.Split(row, "|")
+	if len(cells) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(cells[1])
+}
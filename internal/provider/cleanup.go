@@ -0,0 +1,106 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	actions "github.com/sethvargo/go-githubactions"
+)
+
+// Branch is a branch of the config repo.
+type Branch struct {
+	Name string
+	// CommittedAt is the time of the last commit on the branch.
+	CommittedAt time.Time
+}
+
+// DeploymentBranch is the branch of a deployment, <app>/<stack>, and the source branch its change requests target.
+type DeploymentBranch struct {
+	Branch, Base string
+}
+
+// CleanupOpts configures the cleanup of the deployment branches of a config repo.
+type CleanupOpts struct {
+	Deployments []DeploymentBranch
+	// BranchMaxAge is the age after which a deployment branch without an open change request
+	// is deleted. No branch is deleted when it is zero.
+	BranchMaxAge time.Duration
+}
+
+// Cleanup closes the open change requests of each deployment which were superseded by a newer one,
+// with a comment linking to the replacement. It then deletes the deployment branches without an open
+// change request whose last commit is older than BranchMaxAge.
+// Several change requests are open from one deployment branch after its source branch changed, the one
+// into the source branch is kept, otherwise the one with the highest number is.
+func Cleanup(ctx context.Context, p Provider, owner, repo string, opts CleanupOpts) error {
+	for _, d := range opts.Deployments {
+		crs, err := p.ListChangeRequests(ctx, owner, repo, d.Branch)
+		if err != nil {
+			return fmt.Errorf("error listing change requests for %s: %s", d.Branch, err)
+		}
+		crs = filterHead(crs, d.Branch)
+
+		latest := latestChangeRequest(crs, d.Base)
+		for _, cr := range crs {
+			if cr == latest {
+				continue
+			}
+			actions.Infof("closing %s, superseded by %s ...", cr.URL, latest.URL)
+			err = p.CloseChangeRequest(ctx, cr, fmt.Sprintf("Superseded by %s.", latest.URL))
+			if err != nil {
+				return fmt.Errorf("error closing %s: %s", cr.URL, err)
+			}
+		}
+
+		if opts.BranchMaxAge == 0 || latest != nil {
+			continue
+		}
+		branches, err := p.ListBranches(ctx, owner, repo, d.Branch)
+		if err != nil {
+			return fmt.Errorf("error listing branches for %s: %s", d.Branch, err)
+		}
+		for _, b := range branches {
+			if b.Name != d.Branch || time.Since(b.CommittedAt) < opts.BranchMaxAge {
+				continue
+			}
+			actions.Infof("deleting branch %s, last commit at %s ...", b.Name, b.CommittedAt.UTC().Format(time.RFC3339))
+			err = p.DeleteBranch(ctx, owner, repo, b.Name)
+			if err != nil {
+				return fmt.Errorf("error deleting branch %s: %s", b.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// filterHead returns the change requests from the head branch, as listing by prefix also
+// returns those of other branches starting with it.
+func filterHead(crs []*ChangeRequest, head string) []*ChangeRequest {
+	out := []*ChangeRequest{}
+	for _, cr := range crs {
+		if cr.Head == head {
+			out = append(out, cr)
+		}
+	}
+	return out
+}
+
+// latestChangeRequest returns the change request into base with the highest number, or the one
+// with the highest number if none is into base.
+func latestChangeRequest(crs []*ChangeRequest, base string) *ChangeRequest {
+	var latest *ChangeRequest
+	for _, cr := range crs {
+		switch {
+		case latest == nil:
+			latest = cr
+		case (cr.Base == base) != (latest.Base == base):
+			if cr.Base == base {
+				latest = cr
+			}
+		case cr.Number > latest.Number:
+			latest = cr
+		}
+	}
+	return latest
+}
@@ -0,0 +1,39 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// DiffCommentMarker identifies the sticky diff comment of a change request.
+	DiffCommentMarker = "<!-- gitops-actions:diff -->"
+	// MaxCommentLength is the maximum length of a comment body on GitHub.
+	MaxCommentLength = 65536
+)
+
+// DiffComment returns the body of the sticky comment showing the diff of the target files
+// in a collapsible section for the stack.
+// Diffs which don't fit in MaxCommentLength are cut at the last full line which fits.
+func DiffComment(stack, diff string) string {
+	fence := "```"
+	for strings.Contains(diff, fence) {
+		fence += "`"
+	}
+	head := fmt.Sprintf("%s\n### Diff\n\n<details open><summary><code>%s</code></summary>\n\n%sdiff\n", DiffCommentMarker, stack, fence)
+	tail := fmt.Sprintf("%s\n\n</details>\n", fence)
+
+	diff = strings.TrimSuffix(diff, "\n")
+	if len(head)+len(diff)+len(tail) > MaxCommentLength {
+		lines := strings.Count(diff, "\n") + 1
+		// reserve room for the truncation note, the number of lines fits in 20 characters.
+		note := "\n\n_The diff is truncated, %d more lines are not shown._"
+		budget := MaxCommentLength - len(head) - len(tail) - len(note) - 20
+		diff = diff[:budget]
+		if i := strings.LastIndex(diff, "\n"); i >= 0 {
+			diff = diff[:i]
+		}
+		tail = fmt.Sprintf("%s"+note+"\n\n</details>\n", fence, lines-strings.Count(diff, "\n")-1)
+	}
+	return head + diff + "\n" + tail
+}
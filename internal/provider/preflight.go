@@ -0,0 +1,134 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"gitops-actions/internal/config"
+)
+
+// PreflightResult is the outcome of one preflight check, it failed if Err is set.
+type PreflightResult struct {
+	Check  string
+	Target string
+	Err    error
+}
+
+// Preflight checks that the credentials can read the config repo, push to it, open change requests
+// and read their checks when a deployment waits for them, that the source branch, app directory and target files of each deployment
+// exist, and that the merge method of each auto-deployed stack is allowed.
+// The remaining checks are skipped once the config repo can't be read.
+func Preflight(ctx context.Context, p Provider, c *config.GitOpsConfig) []PreflightResult {
+	owner, repo := c.Spec.ConfigRepo.Owner, c.Spec.ConfigRepo.Repo
+	target := fmt.Sprintf("%s/%s", owner, repo)
+
+	access, err := p.GetAccess(ctx, owner, repo)
+	if err == nil && !access.Read {
+		err = fmt.Errorf("no read access")
+	}
+	results := []PreflightResult{{Check: "read repo", Target: target, Err: err}}
+	if err != nil {
+		return results
+	}
+	results = append(results,
+		PreflightResult{Check: "push branches", Target: target, Err: accessErr(access.Push, "no push access")},
+		PreflightResult{Check: "open PRs", Target: target, Err: accessErr(access.ChangeRequests, "no access to open pull requests")},
+	)
+	if waitsForChecks(c) {
+		results = append(results, PreflightResult{Check: "read checks", Target: target, Err: accessErr(access.Checks, "no access to read checks")})
+	}
+
+	branches := map[string]bool{}
+	for _, d := range c.Spec.Deployments {
+		exists, checked := branches[d.SourceBranch]
+		if !checked {
+			exists, err = p.BranchExists(ctx, owner, repo, d.SourceBranch)
+			if err == nil && !exists {
+				err = fmt.Errorf("branch not found")
+			}
+			branches[d.SourceBranch] = exists
+			results = append(results, PreflightResult{Check: "source branch", Target: d.SourceBranch, Err: err})
+		}
+		if !exists {
+			continue
+		}
+
+		appPath := c.AppPath(d.TargetStack)
+		results = append(results, pathResult(ctx, p, owner, repo, d.SourceBranch, "app directory", appPath))
+		for _, tf := range c.Spec.TargetFiles {
+			results = append(results, pathResult(ctx, p, owner, repo, d.SourceBranch, "target file", path.Join(appPath, tf.Path)))
+		}
+	}
+
+	methods := map[string]bool{}
+	for _, d := range c.Spec.Deployments {
+		method := d.GetMergeMethod()
+		if !d.AutoDeploy || methods[method] {
+			continue
+		}
+		methods[method] = true
+		results = append(results, PreflightResult{
+			Check:  "merge method",
+			Target: method,
+			Err:    p.ValidateMergeMethod(ctx, owner, repo, method),
+		})
+	}
+	return results
+}
+
+// PreflightFailed returns the number of failed preflight checks.
+func PreflightFailed(results []PreflightResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// PreflightTable formats the preflight results as a table of lines.
+func PreflightTable(results []PreflightResult) []string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tTARGET\tRESULT")
+	for _, r := range results {
+		result := "✅ pass"
+		if r.Err != nil {
+			result = fmt.Sprintf("❌ fail: %s", r.Err)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Check, r.Target, result)
+	}
+	w.Flush()
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+// waitsForChecks returns true if a deployment waits for checks, to merge its change request or
+// to mark its draft ready.
+func waitsForChecks(c *config.GitOpsConfig) bool {
+	for _, d := range c.Spec.Deployments {
+		if d.AutoDeploy || d.Draft {
+			return true
+		}
+	}
+	return false
+}
+
+func accessErr(ok bool, msg string) error {
+	if ok {
+		return nil
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+func pathResult(ctx context.Context, p Provider, owner, repo, ref, check, file string) PreflightResult {
+	exists, err := p.PathExists(ctx, owner, repo, ref, file)
+	if err == nil && !exists {
+		err = fmt.Errorf("not found on %s", ref)
+	}
+	return PreflightResult{Check: check, Target: file, Err: err}
+}
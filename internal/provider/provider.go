@@ -0,0 +1,249 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+	actions "github.com/sethvargo/go-githubactions"
+
+	"gitops-actions/internal/config"
+)
+
+var (
+	// ErrChangeRequestExists is returned when an open change request already exists for the head branch.
+	ErrChangeRequestExists = errors.New("pull request already exists")
+	// ErrCheckFailed matches the CheckStateError of selected checks which concluded as failed.
+	ErrCheckFailed = errors.New(CheckStateFailed)
+	// ErrApprovalRequired is returned while a change request waits for a required approval.
+	ErrApprovalRequired = errors.New("ApprovalRequired")
+)
+
+// States of the selected checks of a change request reported by CheckStateError.
+const (
+	CheckStateFailed   = "CheckFailed"
+	CheckStatePending  = "CheckNotCompleted"
+	CheckStateNotFound = "NoChecksFound"
+)
+
+// CheckStateError is returned while the selected checks of a change request haven't all succeeded.
+type CheckStateError struct {
+	State string
+	// Checks are the failed checks with their conclusion, or the pending checks.
+	Checks []string
+}
+
+func (e *CheckStateError) Error() string {
+	if len(e.Checks) == 0 {
+		return e.State
+	}
+	return fmt.Sprintf("%s: %s", e.State, strings.Join(e.Checks, ", "))
+}
+
+// Is makes a CheckStateError of failed checks match ErrCheckFailed.
+func (e *CheckStateError) Is(target error) bool {
+	return target == ErrCheckFailed && e.State == CheckStateFailed
+}
+
+// ChangeRequest is a pull request or merge request opened in the config repo.
+type ChangeRequest struct {
+	Owner, Repo string
+	Number      int
+	URL         string
+	Head, Base  string
+	Title, Body string
+	Draft       bool
+}
+
+// Access is the access of the credentials to a repo.
+type Access struct {
+	Read bool
+	// Push allows pushing the deployment branches.
+	Push bool
+	// ChangeRequests allows opening and merging change requests.
+	ChangeRequests bool
+	// Checks allows reading the checks of change requests.
+	Checks bool
+}
+
+// Metadata holds the labels and people set on a change request.
+type Metadata struct {
+	Labels        []string
+	Reviewers     []string
+	TeamReviewers []string
+	Assignees     []string
+}
+
+// IsEmpty returns true if there is no metadata to set.
+func (m *Metadata) IsEmpty() bool {
+	return len(m.Labels) == 0 && len(m.Reviewers) == 0 && len(m.TeamReviewers) == 0 && len(m.Assignees) == 0
+}
+
+// DeployOpts configures how a change request is deployed.
+type DeployOpts struct {
+	Checks        config.Checks
+	Wait          config.Wait
+	MergeMode     string
+	WaitForMerged bool
+	Merge         MergeOpts
+	// OnChecksPassed is called once the checks passed, before the merge. It is optional.
+	OnChecksPassed func()
+	// OnMerged is called once the change request is merged, or seen merged by the host. It is optional.
+	OnMerged func()
+}
+
+// MergeOpts configures the merge of a change request.
+type MergeOpts struct {
+	// Method is one of the config.MergeMethod values.
+	Method string
+	// CommitTitle and CommitBody are the rendered merge commit message, empty for the host default.
+	CommitTitle, CommitBody string
+}
+
+// Provider opens change requests on a git host, waits for their checks and merges them.
+type Provider interface {
+	// CreateChangeRequest opens a change request from head into base, as a draft if draft is set.
+	// It returns ErrChangeRequestExists if one is already open for head.
+	CreateChangeRequest(ctx context.Context, owner, repo, head, base, title, body string, draft bool) (*ChangeRequest, error)
+	// GetChangeRequest returns the open change request for head.
+	GetChangeRequest(ctx context.Context, owner, repo, head string) (*ChangeRequest, error)
+	// DeployChangeRequest waits for the selected checks of the change request to pass and merges it.
+	DeployChangeRequest(ctx context.Context, cr *ChangeRequest, opts *DeployOpts) error
+	// WaitForChecks waits for the selected checks of the change request to pass.
+	WaitForChecks(ctx context.Context, cr *ChangeRequest, checks config.Checks, wait config.Wait) error
+	// MarkReady marks a draft change request as ready for review.
+	MarkReady(ctx context.Context, cr *ChangeRequest) error
+	// UpdateChangeRequest replaces the title and body of the change request.
+	UpdateChangeRequest(ctx context.Context, cr *ChangeRequest, title, body string) error
+	// SetMetadata adds the labels, reviewers and assignees to the change request.
+	SetMetadata(ctx context.Context, cr *ChangeRequest, meta *Metadata) error
+	// RemoveLabels removes the labels from the change request. Labels which are not set are ignored.
+	RemoveLabels(ctx context.Context, cr *ChangeRequest, labels []string) error
+	// ValidateMergeMethod returns an error if the merge method is not allowed in the repo.
+	ValidateMergeMethod(ctx context.Context, owner, repo, method string) error
+	// ListChangeRequests returns the open change requests whose head branch starts with prefix.
+	ListChangeRequests(ctx context.Context, owner, repo, prefix string) ([]*ChangeRequest, error)
+	// CloseChangeRequest leaves the comment on the change request and closes it.
+	CloseChangeRequest(ctx context.Context, cr *ChangeRequest, comment string) error
+	// ListBranches returns the branches whose name starts with prefix.
+	ListBranches(ctx context.Context, owner, repo, prefix string) ([]*Branch, error)
+	// DeleteBranch deletes the branch.
+	DeleteBranch(ctx context.Context, owner, repo, branch string) error
+	// UpsertComment updates the comment of the change request which contains marker,
+	// or adds a new comment if there is none.
+	UpsertComment(ctx context.Context, cr *ChangeRequest, marker, body string) error
+	// GetAccess returns the access of the credentials to the repo, as reported by the host.
+	GetAccess(ctx context.Context, owner, repo string) (*Access, error)
+	// BranchExists returns true if the branch exists.
+	BranchExists(ctx context.Context, owner, repo, branch string) (bool, error)
+	// PathExists returns true if the file or directory exists at ref.
+	PathExists(ctx context.Context, owner, repo, ref, path string) (bool, error)
+}
+
+// WaitAndMerge polls waitForChecks until it succeeds and then retries merge until it succeeds.
+// Both are bounded by the timeouts of the wait config of the deploy options.
+func WaitAndMerge(ctx context.Context, opts *DeployOpts, waitForChecks, merge func() error) error {
+	return WaitApproveAndMerge(ctx, opts, waitForChecks, nil, merge)
+}
+
+// WaitApproveAndMerge is WaitAndMerge with approved polled between the checks and the merge, within the
+// approval timeout, for hosts whose change requests wait for a human approval. approved is optional.
+func WaitApproveAndMerge(ctx context.Context, opts *DeployOpts, waitForChecks, approved, merge func() error) error {
+	wait := opts.Wait.WithDefaults()
+	err := PollChecks(ctx, wait, waitForChecks)
+	if err != nil {
+		return err
+	}
+	if approved != nil {
+		err = PollApproval(ctx, wait, approved)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.OnChecksPassed != nil {
+		opts.OnChecksPassed()
+	}
+
+	err = poll(ctx, wait, wait.MergeTimeout, merge,
+		retry.OnRetry(func(n uint, err error) {
+			actions.Infof("attempt: %d to merge PR: %v", n, err)
+		}),
+	)
+	if err == nil && opts.OnMerged != nil {
+		opts.OnMerged()
+	}
+	return err
+}
+
+// PollChecks waits for the initial delay and polls waitForChecks until it succeeds or the checks
+// timeout of the wait config expires. Polling stops right away once waitForChecks returns ErrCheckFailed.
+func PollChecks(ctx context.Context, wait config.Wait, waitForChecks func() error) error {
+	wait = wait.WithDefaults()
+	err := Sleep(ctx, wait.InitialDelay)
+	if err != nil {
+		return err
+	}
+
+	return poll(ctx, wait, wait.ChecksTimeout, waitForChecks,
+		retry.RetryIf(func(err error) bool { return !errors.Is(err, ErrCheckFailed) }),
+		retry.OnRetry(func(n uint, err error) {
+			actions.Infof("waiting for checks to pass: %v", err)
+		}),
+	)
+}
+
+// PollApproval polls approved until it succeeds or the approval timeout of the wait config expires.
+func PollApproval(ctx context.Context, wait config.Wait, approved func() error) error {
+	wait = wait.WithDefaults()
+	return poll(ctx, wait, wait.ApprovalTimeout, approved,
+		retry.OnRetry(func(n uint, err error) {
+			actions.Infof("waiting for approval: %v", err)
+		}),
+	)
+}
+
+// Sleep waits for the duration, or until the context is done.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// poll retries f with exponential backoff and jitter until it succeeds, the timeout expires or the parent
+// context is done.
+func poll(parent context.Context, wait config.Wait, timeout time.Duration, f func() error, opts ...retry.Option) error {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	var lastErr error
+	opts = append([]retry.Option{
+		retry.Context(ctx),
+		retry.UntilSucceeded(),
+		retry.Delay(wait.PollInterval),
+		retry.MaxDelay(wait.MaxPollInterval),
+		retry.MaxJitter(wait.PollInterval),
+		retry.DelayType(retry.CombineDelay(retry.BackOffDelay, retry.RandomDelay)),
+		retry.LastErrorOnly(true),
+	}, opts...)
+	err := retry.Do(func() error {
+		lastErr = f()
+		return lastErr
+	}, opts...)
+	if err != nil && parent.Err() != nil {
+		if lastErr == nil {
+			return parent.Err()
+		}
+		return fmt.Errorf("%w, last error: %w", parent.Err(), lastErr)
+	}
+	if err != nil && ctx.Err() != nil && lastErr != nil {
+		return fmt.Errorf("timed out after %s: %w", timeout, lastErr)
+	}
+	return err
+}
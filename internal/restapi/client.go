@@ -0,0 +1,84 @@
+package restapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Client is a minimal JSON client for the REST APIs of GitLab and Gitea.
+type Client struct {
+	HTTP *http.Client
+	// Name is the name of the API in errors, e.g. gitlab.
+	Name    string
+	BaseURL string
+	// AuthHeader is set to AuthValue on each request.
+	AuthHeader, AuthValue string
+}
+
+// APIError is returned for responses with a non-2xx status code.
+type APIError struct {
+	API        string
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s api error: %d %s", e.API, e.StatusCode, e.Message)
+}
+
+// HasStatus returns true if err is an APIError with the status code.
+func HasStatus(err error, statusCode int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == statusCode
+}
+
+// Exists turns the error of a request for a resource into whether it exists.
+func Exists(err error) (bool, error) {
+	if HasStatus(err, http.StatusNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Do sends in as the JSON body of the request, if set, and decodes the JSON response into out, if set.
+func (c *Client) Do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(c.AuthHeader, c.AuthValue)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &APIError{API: c.Name, StatusCode: resp.StatusCode, Message: string(respBody)}
+	}
+	if out != nil && len(respBody) > 0 {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
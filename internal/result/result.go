@@ -0,0 +1,109 @@
+package result
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	actions "github.com/sethvargo/go-githubactions"
+)
+
+// Reasons for skipping the merge of a deployment.
+const (
+	// SkippedNoChanges is set when the target files already had the value.
+	SkippedNoChanges = "no-changes"
+	// SkippedManual is set when the stack is not auto-deployed, the PR is left open.
+	SkippedManual = "manual"
+	// SkippedAutoMerge is set when the PR is merged later by the auto-merge or merge queue of the host.
+	SkippedAutoMerge = "auto-merge"
+)
+
+// Run is the result of a run, written as a JSON document for the following steps of the workflow.
+type Run struct {
+	App         string        `json:"app"`
+	Value       string        `json:"value"`
+	Deployments []*Deployment `json:"deployments"`
+	// Error is the error which stopped the run, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Deployment is the result of the deployment of a stack.
+type Deployment struct {
+	Stack     string `json:"stack"`
+	Branch    string `json:"branch"`
+	CommitSha string `json:"commitSha,omitempty"`
+	PRNumber  int    `json:"prNumber,omitempty"`
+	PRUrl     string `json:"prUrl,omitempty"`
+	Merged    bool   `json:"merged"`
+	// Skipped is the reason the PR was not merged by the run, one of the Skipped values.
+	Skipped string `json:"skipped,omitempty"`
+	// Completed is set once the deployment finished without error.
+	Completed bool   `json:"completed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Start adds the deployment of the stack to the run.
+func (r *Run) Start(stack, branch string) *Deployment {
+	d := &Deployment{Stack: stack, Branch: branch}
+	r.Deployments = append(r.Deployments, d)
+	return d
+}
+
+// Fail records the error which stopped the run on the deployment in progress, if any.
+func (r *Run) Fail(err string) {
+	r.Error = err
+	if n := len(r.Deployments); n > 0 && !r.Deployments[n-1].Completed {
+		r.Deployments[n-1].Error = err
+	}
+}
+
+// Completed returns the stacks of the completed deployments.
+func (r *Run) Completed() []string {
+	stacks := []string{}
+	for _, d := range r.Deployments {
+		if d.Completed {
+			stacks = append(stacks, d.Stack)
+		}
+	}
+	return stacks
+}
+
+// Write writes the run as a JSON document to the file and sets the outputs of the step:
+// result and result-file for the run, and <stack>-pr-url, <stack>-pr-number, <stack>-branch,
+// <stack>-commit-sha, <stack>-merged and <stack>-skipped-reason for each deployment.
+func (r *Run) Write(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing result file: %s", err)
+	}
+	actions.SetOutput("result", string(b))
+	actions.SetOutput("result-file", path)
+
+	for _, d := range r.Deployments {
+		prefix := outputName(d.Stack)
+		prNumber := ""
+		if d.PRNumber != 0 {
+			prNumber = strconv.Itoa(d.PRNumber)
+		}
+		actions.SetOutput(prefix+"-pr-url", d.PRUrl)
+		actions.SetOutput(prefix+"-pr-number", prNumber)
+		actions.SetOutput(prefix+"-branch", d.Branch)
+		actions.SetOutput(prefix+"-commit-sha", d.CommitSha)
+		actions.SetOutput(prefix+"-merged", strconv.FormatBool(d.Merged))
+		actions.SetOutput(prefix+"-skipped-reason", d.Skipped)
+	}
+	return nil
+}
+
+var invalidOutputChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// outputName replaces the characters which are not allowed in output names.
+func outputName(stack string) string {
+	return invalidOutputChars.ReplaceAllString(stack, "_")
+}
@@ -0,0 +1,93 @@
+package tmpl
+
+// DefaultBody is the template of the PR body used when no template is provided.
+const DefaultBody = `Automated PR to {{ .Branch }} with the new value ` + "`{{ .Value }}`" + `
+{{- if .SourceCommitUrl }}
+
+Source commit: [{{ short .SourceSha }}]({{ .SourceCommitUrl }}){{ if .RunUrl }} ([workflow run]({{ .RunUrl }})){{ end }}
+{{- end }}
+{{- if .Files }}
+
+| File | Previous value | New value |
+| --- | --- | --- |
+{{- range .Files }}
+| ` + "`{{ .Path }}`" + ` | {{ if .Previous }}` + "`{{ .Previous }}`" + `{{ else }}-{{ end }} | ` + "`{{ .Value }}`" + ` |
+{{- end }}
+{{- end }}
+{{- with .Changelog }}
+
+### Changelog
+
+[Compare {{ short .Base }}...{{ short .Head }}]({{ .Url }})
+
+<details><summary>{{ .TotalCommits }} commit(s)</summary>
+{{ range .Commits }}
+- [{{ short .Sha }}]({{ .Url }}) {{ firstLine .Message }}{{ if .Author }} (@{{ .Author }}){{ end }}
+{{- end }}
+{{- if gt .TotalCommits (len .Commits) }}
+- ... and {{ sub .TotalCommits (len .Commits) }} more
+{{- end }}
+
+</details>
+
+<details><summary>{{ .TotalFiles }} file(s) changed</summary>
+
+| File | Status | + | - |
+| --- | --- | --- | --- |
+{{- range .Files }}
+| ` + "`{{ .Name }}`" + ` | {{ .Status }} | {{ .Additions }} | {{ .Deletions }} |
+{{- end }}
+{{- if gt .TotalFiles (len .Files) }}
+
+... and {{ sub .TotalFiles (len .Files) }} more
+{{- end }}
+
+</details>
+{{- end }}
+`
+
+// BodyData holds the values available to the PR body template.
+type BodyData struct {
+	*Data
+	// Branch is the deployment branch in the config repo.
+	Branch string
+	// PreviousValue is the value deployed before this change, if it could be read.
+	PreviousValue string
+	Files         []FileChange
+	// Changelog lists the source changes between the previous and the new value, if they could be compared.
+	Changelog *Changelog
+}
+
+// FileChange is the update of a single target file.
+type FileChange struct {
+	Path     string
+	Previous string
+	Value    string
+}
+
+// Changelog is the comparison of two refs in the source repo.
+type Changelog struct {
+	Base         string
+	Head         string
+	Url          string
+	Commits      []ChangelogCommit
+	TotalCommits int
+	Files        []ChangedFile
+	TotalFiles   int
+}
+
+// ChangelogCommit is a commit of the changelog.
+type ChangelogCommit struct {
+	Sha     string
+	Message string
+	Author  string
+	Url     string
+}
+
+// ChangedFile is the summary of the changes to a file in the changelog.
+type ChangedFile struct {
+	Name      string
+	Status    string
+	Additions int
+	Deletions int
+}
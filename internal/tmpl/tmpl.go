@@ -0,0 +1,134 @@
+package tmpl
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	actions "github.com/sethvargo/go-githubactions"
+)
+
+// Data holds the values available to user provided templates.
+type Data struct {
+	App        string
+	Stack      string
+	Value      string
+	SourceRepo string
+	SourceSha  string
+	// SourceRef is the name of the branch or tag which triggered the workflow.
+	SourceRef string
+	// SourceCommitUrl is the URL of the source commit in the source repo.
+	SourceCommitUrl string
+	RunUrl          string
+	Actor           string
+	// PRNumber is the number of the PR in the config repo, once it is known.
+	PRNumber int
+}
+
+// NewData creates the template data of a run, filling the source fields from the GitHub Actions context.
+func NewData(app, value string) *Data {
+	d := &Data{
+		App:   app,
+		Value: value,
+	}
+	ghCtx, err := actions.Context()
+	if err != nil {
+		actions.Debugf("error reading github actions context: %s", err)
+		return d
+	}
+	d.SourceRepo = ghCtx.Repository
+	d.SourceSha = ghCtx.SHA
+	d.SourceRef = ghCtx.RefName
+	d.Actor = ghCtx.Actor
+	if ghCtx.Repository != "" && ghCtx.SHA != "" {
+		d.SourceCommitUrl = fmt.Sprintf("%s/%s/commit/%s", ghCtx.ServerURL, ghCtx.Repository, ghCtx.SHA)
+	}
+	if ghCtx.Repository != "" && ghCtx.RunID != 0 {
+		d.RunUrl = fmt.Sprintf("%s/%s/actions/runs/%d", ghCtx.ServerURL, ghCtx.Repository, ghCtx.RunID)
+	}
+	return d
+}
+
+// ForStack returns a copy of the data for the given stack.
+func (d *Data) ForStack(stack string) *Data {
+	c := *d
+	c.Stack = stack
+	return &c
+}
+
+// funcs are the helper functions available to templates.
+var funcs = template.FuncMap{
+	"short": func(s string) string {
+		if len(s) > 7 {
+			return s[:7]
+		}
+		return s
+	},
+	"firstLine": func(s string) string {
+		line, _, _ := strings.Cut(s, "\n")
+		return strings.TrimSpace(line)
+	},
+	"sub": func(a, b int) int {
+		return a - b
+	},
+}
+
+// Render executes the text template with the given data.
+func Render(name, text string, data any) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Funcs(funcs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s template: %s", name, err)
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("error rendering %s template: %s", name, err)
+	}
+	return buf.String(), nil
+}
+
+// RenderAll renders each of the text templates with the given data.
+func RenderAll(name string, texts []string, data *Data) ([]string, error) {
+	out := make([]string, 0, len(texts))
+	for _, text := range texts {
+		r, err := Render(name, text, data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// CommitMessage renders the commit message template and appends the rendered Git trailers.
+// Each trailer has the form "Token: value", for example "Source-Commit: {{ .SourceSha }}".
+// Trailers which render to an empty value are left out.
+func CommitMessage(text string, trailers []string, data *Data) (string, error) {
+	msg, err := Render("commit message", text, data)
+	if err != nil {
+		return "", err
+	}
+	msg = strings.TrimSpace(msg)
+
+	lines := []string{}
+	for _, t := range trailers {
+		token, value, ok := strings.Cut(t, ":")
+		token = strings.TrimSpace(token)
+		if !ok || token == "" || strings.ContainsAny(token, " \t") {
+			return "", fmt.Errorf("invalid commit trailer %q, expected \"Token: value\"", t)
+		}
+		value, err = Render("commit trailer", strings.TrimSpace(value), data)
+		if err != nil {
+			return "", err
+		}
+		if value == "" {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", token, value))
+	}
+	if len(lines) > 0 {
+		msg = fmt.Sprintf("%s\n\n%s", msg, strings.Join(lines, "\n"))
+	}
+	return msg, nil
+}
@@ -0,0 +1,83 @@
+package updater
+
+import (
+	"bytes"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	fdiff "github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Change is the update of a single target file.
+type Change struct {
+	Path     string
+	Old, New []byte
+}
+
+// Diff returns the unified diff of the changes, in the format of git diff.
+func Diff(changes []Change) (string, error) {
+	p := &patch{}
+	for _, c := range changes {
+		p.files = append(p.files, newFilePatch(c))
+	}
+	var buf bytes.Buffer
+	err := fdiff.NewUnifiedEncoder(&buf, fdiff.DefaultContextLines).Encode(p)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// patch implements the go-git diff.Patch interface for in memory changes.
+type patch struct {
+	files []fdiff.FilePatch
+}
+
+func (p *patch) FilePatches() []fdiff.FilePatch { return p.files }
+func (p *patch) Message() string                { return "" }
+
+type filePatch struct {
+	from, to *file
+	chunks   []fdiff.Chunk
+}
+
+func newFilePatch(c Change) *filePatch {
+	fp := &filePatch{
+		from: &file{path: c.Path, hash: plumbing.ComputeHash(plumbing.BlobObject, c.Old)},
+		to:   &file{path: c.Path, hash: plumbing.ComputeHash(plumbing.BlobObject, c.New)},
+	}
+	for _, d := range diff.Do(string(c.Old), string(c.New)) {
+		op := fdiff.Equal
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			op = fdiff.Add
+		case diffmatchpatch.DiffDelete:
+			op = fdiff.Delete
+		}
+		fp.chunks = append(fp.chunks, &chunk{content: d.Text, op: op})
+	}
+	return fp
+}
+
+func (fp *filePatch) IsBinary() bool                  { return false }
+func (fp *filePatch) Files() (fdiff.File, fdiff.File) { return fp.from, fp.to }
+func (fp *filePatch) Chunks() []fdiff.Chunk           { return fp.chunks }
+
+type file struct {
+	path string
+	hash plumbing.Hash
+}
+
+func (f *file) Hash() plumbing.Hash     { return f.hash }
+func (f *file) Mode() filemode.FileMode { return filemode.Regular }
+func (f *file) Path() string            { return f.path }
+
+type chunk struct {
+	content string
+	op      fdiff.Operation
+}
+
+func (c *chunk) Content() string       { return c.content }
+func (c *chunk) Type() fdiff.Operation { return c.op }
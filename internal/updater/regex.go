@@ -2,27 +2,33 @@ package updater
 
 import (
 	"fmt"
-	"log"
-	"os"
 	"regexp"
+	"strings"
 )
 
-func RegexReplace(path, pattern, tmpl, value string) error {
-	contentByte, err := os.ReadFile(path)
+func RegexReplace(content []byte, pattern, tmpl, value string) ([]byte, error) {
+	regex, err := regexp.Compile(pattern)
 	if err != nil {
-		log.Fatalf("error opening file: %s", err)
+		return nil, err
 	}
+	result := regex.ReplaceAllString(string(content), fmt.Sprintf("%s%s", tmpl, value))
+	return []byte(result), nil
+}
 
+// RegexValue returns the value following the expanded template in the first match of the pattern.
+func RegexValue(content []byte, pattern, tmpl string) (string, error) {
 	regex, err := regexp.Compile(pattern)
 	if err != nil {
-		return err
+		return "", err
 	}
-	result := regex.ReplaceAllString(string(contentByte), fmt.Sprintf("%s%s", tmpl, value))
-
-	err = os.WriteFile(path, []byte(result), 0644)
-	if err != nil {
-		log.Fatalf("error writing to file: %s", err)
+	match := regex.FindSubmatchIndex(content)
+	if match == nil {
+		return "", nil
 	}
-
-	return nil
+	prefix := string(regex.Expand(nil, []byte(tmpl), content, match))
+	value := string(content[match[0]:match[1]])
+	if !strings.HasPrefix(value, prefix) {
+		return "", nil
+	}
+	return strings.TrimPrefix(value, prefix), nil
 }
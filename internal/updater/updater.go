@@ -1,27 +1,75 @@
 package updater
 
 import (
+	"bytes"
 	"fmt"
+	"os"
+
 	"gitops-actions/internal/config"
 )
 
-func UpdateFiles(targetFiles []config.TargetFile, basePath, value string) error {
+// UpdateFiles updates the target files under basePath on disk with the given value.
+// It returns the changed files, with paths relative to basePath.
+func UpdateFiles(targetFiles []config.TargetFile, basePath, value string) ([]Change, error) {
+	changes := []Change{}
 	for _, tf := range targetFiles {
 		path := fmt.Sprintf("%s/%s", basePath, tf.Path)
-		switch tf.Replacer {
-		case "regex":
-			err := RegexReplace(path, tf.Regex.Pattern, tf.Regex.Tmpl, value)
-			if err != nil {
-				return err
-			}
-		case "yaml":
-			err := UpdateYaml(path, tf.Key, value)
-			if err != nil {
-				return err
-			}
-		default:
-			return fmt.Errorf("invalid replacer: %s", tf.Replacer)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening file: %s", err)
+		}
+		updated, err := UpdateContent(tf, content, value)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(path, updated, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error writing to file: %s", err)
+		}
+		if !bytes.Equal(content, updated) {
+			changes = append(changes, Change{Path: tf.Path, Old: content, New: updated})
+		}
+	}
+	return changes, nil
+}
+
+// UpdateContent applies the replacer of a target file to its in-memory content.
+func UpdateContent(tf config.TargetFile, content []byte, value string) ([]byte, error) {
+	switch tf.Replacer {
+	case "regex":
+		return RegexReplace(content, tf.Regex.Pattern, tf.Regex.Tmpl, value)
+	case "yaml":
+		return UpdateYaml(content, tf.Key, value)
+	default:
+		return nil, fmt.Errorf("invalid replacer: %s", tf.Replacer)
+	}
+}
+
+// CurrentValue returns the value currently set in the content of a target file.
+// It returns an empty string if the value can't be found.
+func CurrentValue(tf config.TargetFile, content []byte) (string, error) {
+	switch tf.Replacer {
+	case "regex":
+		return RegexValue(content, tf.Regex.Pattern, tf.Regex.Tmpl)
+	case "yaml":
+		return YamlValue(content, tf.Key)
+	default:
+		return "", fmt.Errorf("invalid replacer: %s", tf.Replacer)
+	}
+}
+
+// CurrentValues returns the values currently set in the target files, keyed by the path of the target file.
+func CurrentValues(targetFiles []config.TargetFile, basePath string) (map[string]string, error) {
+	values := make(map[string]string, len(targetFiles))
+	for _, tf := range targetFiles {
+		content, err := os.ReadFile(fmt.Sprintf("%s/%s", basePath, tf.Path))
+		if err != nil {
+			return nil, fmt.Errorf("error opening file: %s", err)
+		}
+		values[tf.Path], err = CurrentValue(tf, content)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	return values, nil
 }
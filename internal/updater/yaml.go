@@ -1,34 +1,32 @@
 package updater
 
 import (
-	"os"
+	"fmt"
 
 	"github.com/goccy/go-yaml"
 )
 
-func UpdateYaml(configPath, key, value string) error {
-	file, err := os.Open(configPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
+func UpdateYaml(content []byte, key, value string) ([]byte, error) {
 	ymlConf := make(map[string]interface{})
-	err = yaml.NewDecoder(file).Decode(&ymlConf)
+	err := yaml.Unmarshal(content, &ymlConf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	ymlConf[key] = value
-	content, err := yaml.Marshal(ymlConf)
-	if err != nil {
-		return err
-	}
+	return yaml.Marshal(ymlConf)
+}
 
-	err = os.WriteFile(configPath, []byte(content), 0644)
+// YamlValue returns the value of the top level key.
+func YamlValue(content []byte, key string) (string, error) {
+	ymlConf := make(map[string]interface{})
+	err := yaml.Unmarshal(content, &ymlConf)
 	if err != nil {
-		return err
+		return "", err
 	}
-
-	return nil
+	v, ok := ymlConf[key]
+	if !ok || v == nil {
+		return "", nil
+	}
+	return fmt.Sprint(v), nil
 }